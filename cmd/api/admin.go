@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"goplex.kibonga/internal/data"
+	"goplex.kibonga/internal/validator"
+)
+
+func validUserSortVals() *[]string {
+	return &[]string{"id", "name", "email", "created_at", "-id", "-name", "-email", "-created_at"}
+}
+
+type UserStatusUpdateRequest struct {
+	Activated *bool `json:"activated"`
+	Suspended *bool `json:"suspended"`
+}
+
+type UserPermissionsRequest struct {
+	Permissions []string `json:"permissions"`
+}
+
+func (app *app) readUser(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := app.readIdParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	user, err := app.models.Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return user, true
+}
+
+func (app *app) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	filters := &data.Filters{}
+	urlVals := r.URL.Query()
+
+	v := validator.New()
+
+	search := app.readStr(urlVals, "search", "")
+	filters.PageSize = app.readInt(urlVals, "page_size", v, 20)
+	filters.Page = app.readInt(urlVals, "page", v, 1)
+	filters.Sort = app.readStr(urlVals, "sort", "id")
+	filters.ValidSortValues = *validUserSortVals()
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.models.Users.GetAll(search, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, http.StatusOK, payload{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) showUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUser(w, r)
+	if !ok {
+		return
+	}
+
+	roles, err := app.models.Roles.GetAllForUser(user.Id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.Id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, http.StatusOK, payload{"user": user, "roles": roles, "permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) updateUserStatusHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req UserStatusUpdateRequest
+
+	err := app.decodeJson(r, &req)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if req.Activated != nil {
+		user.Activated = *req.Activated
+	}
+
+	if req.Suspended != nil {
+		user.Suspended = *req.Suspended
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.sessionUsers.forgetUser(user.Id)
+
+	// A suspended user must be locked out straight away, not when their
+	// current tokens happen to expire
+	if user.Suspended {
+		err = app.models.Tokens.DeleteSessionsForUser(user.Id)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJson(w, http.StatusOK, payload{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) readPermissionsRequest(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	var req UserPermissionsRequest
+
+	err := app.decodeJson(r, &req)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return nil, false
+	}
+
+	known, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	v := validator.New()
+	v.Check(len(req.Permissions) > 0, "permissions", "must contain at least one permission")
+	v.Check(validator.Unique(req.Permissions...), "permissions", "must not contain duplicates")
+
+	for _, code := range req.Permissions {
+		v.Check(known.Include(code), "permissions", "must only contain known permission codes")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+
+	return req.Permissions, true
+}
+
+func (app *app) grantUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUser(w, r)
+	if !ok {
+		return
+	}
+
+	codes, ok := app.readPermissionsRequest(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.models.Permissions.AddForUser(user.Id, codes...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeUserPermissions(w, r, user)
+}
+
+func (app *app) revokeUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUser(w, r)
+	if !ok {
+		return
+	}
+
+	codes, ok := app.readPermissionsRequest(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.models.Permissions.RemoveForUser(user.Id, codes...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeUserPermissions(w, r, user)
+}
+
+// writeUserPermissions answers with the effective permissions of the user,
+// which may still include a revoked code if one of their roles grants it.
+func (app *app) writeUserPermissions(w http.ResponseWriter, r *http.Request, user *data.User) {
+	permissions, err := app.models.Permissions.GetAllForUser(user.Id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, http.StatusOK, payload{"user": user, "permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"goplex.kibonga/internal/data"
+)
+
+// movieETag is a strong validator for a movie, every change to a movie bumps
+// its version.
+func movieETag(movie *data.Movie) string {
+	return `"` + strconv.FormatInt(int64(movie.Version), 10) + `"`
+}
+
+// setMovieValidators adds the ETag and Last-Modified headers for movie.
+func setMovieValidators(headers http.Header, movie *data.Movie) {
+	headers.Set("ETag", movieETag(movie))
+	headers.Set("Last-Modified", movie.UpdatedAt.UTC().Format(http.TimeFormat))
+}
+
+// etagListMatches reports whether etag is in the comma separated list of an
+// If-Match or If-None-Match header. RFC 9110 asks for the weak comparison,
+// which ignores a W/ prefix, for If-None-Match only. Under the strong
+// comparison a weak ETag never matches.
+func etagListMatches(header, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// notModified evaluates If-None-Match, or If-Modified-Since when there is no
+// If-None-Match, for a GET of movie.
+func notModified(r *http.Request, movie *data.Movie) bool {
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		return etagListMatches(header, movieETag(movie), true)
+	}
+
+	if header := r.Header.Get("If-Modified-Since"); header != "" {
+		since, err := http.ParseTime(header)
+		if err != nil {
+			return false
+		}
+
+		// Last-Modified only has second precision
+		return !movie.UpdatedAt.Truncate(time.Second).After(since)
+	}
+
+	return false
+}
+
+// checkMoviePreconditions makes sure a client changing movie has seen its
+// latest version, given either as an If-Match header or as version. It sends
+// the error response itself and returns false when the change must not go
+// ahead. given tells whether the client stated a precondition at all.
+func (app *app) checkMoviePreconditions(w http.ResponseWriter, r *http.Request, movie *data.Movie, version *int32) (given bool, ok bool) {
+	header := r.Header.Get("If-Match")
+
+	if header == "" && version == nil {
+		if app.config.preconditions.required {
+			app.preconditionRequiredResponse(w, r)
+			return false, false
+		}
+		return false, true
+	}
+
+	if header != "" && !etagListMatches(header, movieETag(movie), false) {
+		app.preconditionFailedResponse(w, r)
+		return true, false
+	}
+
+	if version != nil && *version != movie.Version {
+		app.preconditionFailedResponse(w, r)
+		return true, false
+	}
+
+	return true, true
+}
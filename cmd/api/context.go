@@ -9,7 +9,15 @@ import (
 
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey    = contextKey("user")
+	tokenContextKey   = contextKey("token")
+	sessionContextKey = contextKey("session")
+	apiKeyContextKey  = contextKey("apiKey")
+	cookieContextKey  = contextKey("cookie")
+
+	impersonatorContextKey = contextKey("impersonator")
+)
 
 func (app *app) contextSetUser(r *http.Request, user *data.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
@@ -25,3 +33,74 @@ func (app *app) contextGetUser(r *http.Request) *data.User {
 
 	return user
 }
+
+func (app *app) contextSetToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+
+	return r.WithContext(ctx)
+}
+
+func (app *app) contextGetToken(r *http.Request) string {
+	token, ok := r.Context().Value(tokenContextKey).(string)
+	if !ok {
+		panic("missing token value in request context")
+	}
+
+	return token
+}
+
+func (app *app) contextSetSessionID(r *http.Request, id int64) *http.Request {
+	ctx := context.WithValue(r.Context(), sessionContextKey, id)
+
+	return r.WithContext(ctx)
+}
+
+// contextGetSessionID returns the id of the session a signed access token was
+// issued for, or 0 when the request wasn't authenticated with one.
+func (app *app) contextGetSessionID(r *http.Request) int64 {
+	id, _ := r.Context().Value(sessionContextKey).(int64)
+
+	return id
+}
+
+func (app *app) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+
+	return r.WithContext(ctx)
+}
+
+// contextGetAPIKey returns the API key the request was authenticated with, or
+// nil when it wasn't authenticated with one.
+func (app *app) contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+
+	return key
+}
+
+func (app *app) contextSetCookieSession(r *http.Request) *http.Request {
+	ctx := context.WithValue(r.Context(), cookieContextKey, true)
+
+	return r.WithContext(ctx)
+}
+
+// contextIsCookieSession reports whether the request was authenticated with a
+// session cookie rather than an Authorization header.
+func (app *app) contextIsCookieSession(r *http.Request) bool {
+	cookie, _ := r.Context().Value(cookieContextKey).(bool)
+
+	return cookie
+}
+
+func (app *app) contextSetImpersonatorID(r *http.Request, id int64) *http.Request {
+	ctx := context.WithValue(r.Context(), impersonatorContextKey, id)
+
+	return r.WithContext(ctx)
+}
+
+// contextGetImpersonatorID returns the id of the admin acting as the user from
+// contextGetUser, or 0 when the user is acting themselves.
+func (app *app) contextGetImpersonatorID(r *http.Request) int64 {
+	id, _ := r.Context().Value(impersonatorContextKey).(int64)
+
+	return id
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/tomasen/realip"
+	"goplex.kibonga/internal/data"
+)
+
+const (
+	sessionCookieName = "goplex_session"
+	csrfCookieName    = "goplex_csrf"
+	csrfHeaderName    = "X-CSRF-Token"
+)
+
+// wantsSessionCookie reports whether a login asked for a session cookie, with
+// ?session=cookie, instead of tokens in the response body.
+func (app *app) wantsSessionCookie(r *http.Request) bool {
+	return app.config.sessions.cookies && r.URL.Query().Get("session") == "cookie"
+}
+
+// writeSessionCookie logs a browser client in. The authentication token goes
+// in an HttpOnly cookie that scripts can't read, next to a CSRF cookie whose
+// value has to be echoed in the X-CSRF-Token header of state-changing
+// requests. The CSRF token is also in the response body, since a front-end on
+// another origin can't read the cookie.
+func (app *app) writeSessionCookie(w http.ResponseWriter, r *http.Request, user *data.User) {
+	token, err := app.models.Tokens.New(user.Id, 24*time.Hour, data.ScopeAuthentication, data.Client{UserAgent: r.UserAgent(), IP: realip.FromRequest(r)})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	csrfToken, err := generateCSRFToken()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token.PlainText,
+		Path:     "/",
+		Expires:  token.Expiry,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	setCSRFCookie(w, csrfToken, token.Expiry)
+
+	err = app.writeJson(w, http.StatusOK, payload{"session": payload{"expiry": token.Expiry}, "csrf_token": csrfToken}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) clearSessionCookies(w http.ResponseWriter) {
+	for _, name := range []string{sessionCookieName, csrfCookieName} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    "",
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: name == sessionCookieName,
+			Secure:   true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+}
+
+// showCSRFTokenHandler hands a cookie session a new CSRF token, for clients
+// that lost the one they got when logging in, like a front-end on another
+// origin after a page reload.
+func (app *app) showCSRFTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.contextIsCookieSession(r) {
+		app.badRequestResponse(w, r, errors.New("only sessions kept in a cookie have a CSRF token"))
+		return
+	}
+
+	csrfToken, err := generateCSRFToken()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The session cookie outlives a CSRF cookie without an expiry at worst
+	// until the browser closes, after which another one can be fetched
+	setCSRFCookie(w, csrfToken, time.Time{})
+
+	err = app.writeJson(w, http.StatusOK, payload{"csrf_token": csrfToken}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func setCSRFCookie(w http.ResponseWriter, csrfToken string, expiry time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    csrfToken,
+		Path:     "/",
+		Expires:  expiry,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func generateCSRFToken() (string, error) {
+	randBytes := make([]byte, 32)
+
+	_, err := rand.Read(randBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(randBytes), nil
+}
+
+// cookielessRoutes work without being logged in, so session cookies are
+// ignored there. Otherwise a client whose cookie is stale or whose CSRF token
+// got lost couldn't log in again.
+var cookielessRoutes = map[string]bool{
+	"POST /v1/users":                             true,
+	"PUT /v1/users/activated":                    true,
+	"PUT /v1/users/password":                     true,
+	"POST /v1/tokens/authentication":             true,
+	"POST /v1/tokens/authentication/2fa":         true,
+	"POST /v1/tokens/refresh":                    true,
+	"POST /v1/tokens/activation":                 true,
+	"POST /v1/tokens/password-reset":             true,
+	"POST /v1/tokens/magic-login":                true,
+	"POST /v1/tokens/magic-login/authentication": true,
+}
+
+// validCSRFToken checks the double-submitted CSRF token. Safe methods don't
+// change anything, so they are let through without one.
+func validCSRFToken(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+
+	cookie, err := r.Cookie(csrfCookieName)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+
+	header := r.Header.Get(csrfHeaderName)
+
+	return subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) == 1
+}
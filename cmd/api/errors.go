@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"time"
 )
 
 func (app *app) logError(r *http.Request, err error) {
@@ -59,6 +60,20 @@ func (app *app) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
 
+func (app *app) tooManyLoginAttemptsResponse(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	w.Header().Set("Retry-After", retryAfterHeader(wait))
+
+	message := "too many failed login attempts, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+func (app *app) accountLockedResponse(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	w.Header().Set("Retry-After", retryAfterHeader(wait))
+
+	message := "this account is temporarily locked due to too many failed login attempts"
+	app.errorResponse(w, r, http.StatusLocked, message)
+}
+
 func (app *app) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid credentials"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
@@ -71,6 +86,40 @@ func (app *app) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *htt
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
+func (app *app) invalidRefreshTokenResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid or expired refresh token"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *app) invalidAPIKeyResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "ApiKey")
+
+	message := "invalid or expired API key"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *app) apiKeyNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this resource can't be accessed with an API key"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *app) invalidSessionCookieResponse(w http.ResponseWriter, r *http.Request) {
+	app.clearSessionCookies(w)
+
+	message := "invalid or expired session, please log in again"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *app) invalidCSRFTokenResponse(w http.ResponseWriter, r *http.Request) {
+	message := "missing or invalid CSRF token"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *app) impersonationNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this action can't be performed while impersonating a user"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
 func (app *app) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	message := "must be authenticated to access this resource"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
@@ -81,7 +130,35 @@ func (app *app) inactiveAccountResponse(w http.ResponseWriter, r *http.Request)
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
 
+func (app *app) suspendedAccountResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account has been suspended"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
 func (app *app) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account doesn't have the necessar permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+func (app *app) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the resource has changed since you last fetched it, please fetch it again and retry"
+	app.errorResponse(w, r, http.StatusPreconditionFailed, message)
+}
+
+// patchTestFailedResponse is for a JSON Patch whose test operation failed.
+// RFC 5789 suggests 409 for a patch that can't apply to the current state.
+func (app *app) patchTestFailedResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.errorResponse(w, r, http.StatusConflict, err.Error())
+}
+
+func (app *app) preconditionRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this request must be made conditional with an If-Match header or a version"
+	app.errorResponse(w, r, http.StatusPreconditionRequired, message)
+}
+
+func (app *app) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Accept-Patch", "application/json, "+mediaTypeMergePatch+", "+mediaTypeJSONPatch)
+
+	message := fmt.Sprintf("the %q content type is not supported for this resource", r.Header.Get("Content-Type"))
+	app.errorResponse(w, r, http.StatusUnsupportedMediaType, message)
+}
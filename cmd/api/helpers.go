@@ -27,6 +27,17 @@ func (app *app) readIdParam(r *http.Request) (int64, error) {
 	return id, nil
 }
 
+func (app *app) readVersionParam(r *http.Request) (int32, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	version, err := strconv.ParseInt(params.ByName("version"), 10, 32)
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("invalid version provided")
+	}
+
+	return int32(version), nil
+}
+
 func (app *app) readStr(qs url.Values, k string, def string) string {
 	s := qs.Get(k)
 
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/tomasen/realip"
+	"goplex.kibonga/internal/data"
+	"goplex.kibonga/internal/validator"
+)
+
+func validAuditLogSortVals() *[]string {
+	return &[]string{"id", "created_at", "-id", "-created_at"}
+}
+
+func (app *app) createImpersonationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUser(w, r)
+	if !ok {
+		return
+	}
+
+	admin := app.contextGetUser(r)
+
+	if user.Id == admin.Id {
+		app.badRequestResponse(w, r, errors.New("you can't impersonate yourself"))
+		return
+	}
+
+	// Admins can't be impersonated, or one admin could act with another's
+	// identity, and their audit trail would say otherwise
+	permissions, err := app.models.Permissions.GetAllForUser(user.Id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if permissions.Include("users:admin") {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	token, err := app.models.Tokens.NewImpersonation(user.Id, admin.Id, app.config.impersonation.ttl, r.UserAgent(), realip.FromRequest(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.AuditLog.Insert(&data.AuditEntry{
+		UserID:         user.Id,
+		ImpersonatorID: admin.Id,
+		Method:         r.Method,
+		Path:           r.URL.RequestURI(),
+		Status:         http.StatusCreated,
+		IP:             realip.FromRequest(r),
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.PrintInfo("impersonation started", map[string]string{
+		"user_id":         strconv.FormatInt(user.Id, 10),
+		"impersonator_id": strconv.FormatInt(admin.Id, 10),
+	})
+
+	err = app.writeJson(w, http.StatusCreated, payload{"impersonation_token": token, "user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) listAuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	filters := &data.Filters{}
+	urlVals := r.URL.Query()
+
+	v := validator.New()
+
+	userID := app.readInt(urlVals, "user_id", v, 0)
+	impersonatorID := app.readInt(urlVals, "impersonator_id", v, 0)
+	filters.PageSize = app.readInt(urlVals, "page_size", v, 20)
+	filters.Page = app.readInt(urlVals, "page", v, 1)
+	filters.Sort = app.readStr(urlVals, "sort", "-id")
+	filters.ValidSortValues = *validAuditLogSortVals()
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	entries, metadata, err := app.models.AuditLog.GetAll(int64(userID), int64(impersonatorID), filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, http.StatusOK, payload{"audit_log": entries, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tomasen/realip"
+	"goplex.kibonga/internal/data"
+)
+
+// loginFailures counts failed logins per client IP over a sliding window. It
+// lives in memory like the rate limiter, per-account failures are kept in the
+// database so they survive restarts and are shared between instances.
+type loginFailures struct {
+	mu      sync.Mutex
+	window  time.Duration
+	clients map[string]*loginFailuresClient
+}
+
+type loginFailuresClient struct {
+	count       int
+	windowStart time.Time
+}
+
+func newLoginFailures(window time.Duration) *loginFailures {
+	f := &loginFailures{
+		window:  window,
+		clients: make(map[string]*loginFailuresClient),
+	}
+
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+
+			f.mu.Lock()
+
+			for ip, client := range f.clients {
+				if time.Since(client.windowStart) > f.window {
+					delete(f.clients, ip)
+				}
+			}
+
+			f.mu.Unlock()
+		}
+	}()
+
+	return f
+}
+
+// retryAfter returns how long ip has to wait before it may try again, zero
+// when it has made fewer than max failed attempts in the current window.
+func (f *loginFailures) retryAfter(ip string, max int) time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	client, found := f.clients[ip]
+	if !found || time.Since(client.windowStart) > f.window || client.count < max {
+		return 0
+	}
+
+	return f.window - time.Since(client.windowStart)
+}
+
+func (f *loginFailures) add(ip string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	client, found := f.clients[ip]
+	if !found || time.Since(client.windowStart) > f.window {
+		client = &loginFailuresClient{windowStart: time.Now()}
+		f.clients[ip] = client
+	}
+
+	client.count++
+}
+
+// loginBackoff is how long to wait after the last failure before the next
+// attempt is allowed. It doubles with every failure past backoffAfter.
+func (app *app) loginBackoff(failedCount int) time.Duration {
+	excess := failedCount - app.config.login.backoffAfter
+	if excess < 0 {
+		return 0
+	}
+
+	backoff := time.Duration(math.Pow(2, float64(excess))) * time.Second
+	if backoff > app.config.login.maxBackoff {
+		return app.config.login.maxBackoff
+	}
+
+	return backoff
+}
+
+// checkLoginAllowed answers the request and returns false when the client IP
+// or the email being logged into has to wait before trying again.
+func (app *app) checkLoginAllowed(w http.ResponseWriter, r *http.Request, email string) bool {
+	if wait := app.loginFailures.retryAfter(realip.FromRequest(r), app.config.login.ipMaxFailures); wait > 0 {
+		app.tooManyLoginAttemptsResponse(w, r, wait)
+		return false
+	}
+
+	attempt, err := app.models.LoginAttempts.Get(email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if attempt.Locked() {
+		app.accountLockedResponse(w, r, time.Until(*attempt.LockedUntil))
+		return false
+	}
+
+	if wait := time.Until(attempt.LastFailedAt.Add(app.loginBackoff(attempt.FailedCount))); wait > 0 {
+		app.tooManyLoginAttemptsResponse(w, r, wait)
+		return false
+	}
+
+	return true
+}
+
+// recordLoginFailure counts a failed login against the client IP and the
+// email. user is nil when no account matches the email. Owners of an account
+// are emailed when it gets locked.
+func (app *app) recordLoginFailure(r *http.Request, email string, user *data.User) error {
+	app.loginFailures.add(realip.FromRequest(r))
+
+	attempt, locked, err := app.models.LoginAttempts.RecordFailure(email, app.config.login.lockAfter, app.config.login.lockDuration)
+	if err != nil {
+		return err
+	}
+
+	if locked && user != nil {
+		app.background(func() {
+			data := map[string]interface{}{
+				"lockedUntil": attempt.LockedUntil.UTC().Format(time.RFC1123),
+			}
+
+			err := app.mailer.Send(user.Email, "account_locked.tmpl", data)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
+	}
+
+	return nil
+}
+
+// recordLoginSuccess clears the failed logins of the email only. Failures of
+// the client IP run out with their window, or logging into an account of
+// their own would let a client guess at other accounts without ever being
+// blocked.
+func (app *app) recordLoginSuccess(email string) error {
+	return app.models.LoginAttempts.Reset(email)
+}
+
+// purgeLoginAttempts forgets the failed logins that no longer hold anyone
+// back, right away and then once an hour until shutdown. Failures are recorded
+// for any email, so the table would otherwise grow without bound.
+func (app *app) purgeLoginAttempts() {
+	window := app.config.login.maxBackoff
+	if app.config.login.lockDuration > window {
+		window = app.config.login.lockDuration
+	}
+
+	app.background(func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+
+		for {
+			_, err := app.models.LoginAttempts.DeleteStale(time.Now().Add(-window))
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-app.shutdown:
+				return
+			}
+		}
+	})
+}
+
+func retryAfterHeader(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
@@ -3,16 +3,19 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	_ "github.com/lib/pq"
+	"goplex.kibonga/internal/breached"
 	"goplex.kibonga/internal/data"
 	"goplex.kibonga/internal/jsonlog"
 	"goplex.kibonga/internal/mailer"
@@ -45,21 +48,78 @@ type config struct {
 		sender   string
 	}
 	cors struct {
-		trustedOrigins []string
+		trustedOrigins   []string
+		allowCredentials bool
+	}
+	sessions struct {
+		cookies bool
+	}
+	impersonation struct {
+		ttl time.Duration
+	}
+	preconditions struct {
+		required bool
+	}
+	movies struct {
+		trashRetention time.Duration
+	}
+	defaultRole  string
+	registration struct {
+		mode string
+	}
+	permissions struct {
+		cacheTTL time.Duration
+	}
+	auth struct {
+		mode            string
+		signingKey      string
+		accessTokenTTL  time.Duration
+		refreshTokenTTL time.Duration
+	}
+	login struct {
+		backoffAfter  int
+		maxBackoff    time.Duration
+		lockAfter     int
+		lockDuration  time.Duration
+		ipMaxFailures int
+		ipWindow      time.Duration
+	}
+	passwords struct {
+		breachedFile string
+	}
+	argon2 struct {
+		memory      uint
+		iterations  uint
+		parallelism uint
 	}
 }
 
 type app struct {
-	config  config
-	logger  *jsonlog.Logger
-	version string
-	models  data.Models
-	mailer  mailer.Mailer
-	wg      sync.WaitGroup
+	config            config
+	logger            *jsonlog.Logger
+	version           string
+	models            data.Models
+	mailer            mailer.Mailer
+	loginFailures     *loginFailures
+	breachedPasswords *breached.Corpus
+	sessionActivity   *sessionActivity
+	sessionUsers      *sessionUsers
+	shutdown          chan struct{}
+	wg                sync.WaitGroup
 }
 
 const defaultMaxIdleTime int = 1000 * 60 * 15
 
+const (
+	authModeStateful  = "stateful"
+	authModeStateless = "stateless"
+)
+
+const (
+	registrationModeOpen   = "open"
+	registrationModeInvite = "invite"
+)
+
 func main() {
 	var cfg config
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
@@ -87,6 +147,37 @@ func main() {
 		cfg.cors.trustedOrigins = strings.Fields(s)
 		return nil
 	})
+	flag.BoolVar(&cfg.cors.allowCredentials, "cors-allow-credentials", false, "Allow trusted origins to send credentials such as cookies")
+
+	flag.BoolVar(&cfg.sessions.cookies, "session-cookies", false, "Let browser clients log in with a session cookie")
+
+	flag.DurationVar(&cfg.impersonation.ttl, "impersonation-ttl", 15*time.Minute, "Impersonation token TTL")
+
+	flag.BoolVar(&cfg.preconditions.required, "require-preconditions", false, "Reject movie changes without If-Match or a version with 428")
+
+	flag.DurationVar(&cfg.movies.trashRetention, "movies-trash-retention", 30*24*time.Hour, "How long deleted movies can be restored before they are purged (0 keeps them forever)")
+
+	flag.StringVar(&cfg.defaultRole, "default-role", "viewer", "Role given to newly registered users")
+	flag.StringVar(&cfg.registration.mode, "registration-mode", registrationModeOpen, "Registration mode (open|invite)")
+	flag.DurationVar(&cfg.permissions.cacheTTL, "permissions-cache-ttl", time.Minute, "Permissions cache TTL (0 disables the cache)")
+
+	flag.StringVar(&cfg.auth.mode, "auth-mode", authModeStateful, "Authentication mode (stateful|stateless)")
+	flag.StringVar(&cfg.auth.signingKey, "auth-signing-key", "", "HMAC key for signed access tokens, at least 32 bytes")
+	flag.DurationVar(&cfg.auth.accessTokenTTL, "auth-access-token-ttl", 15*time.Minute, "Signed access token TTL")
+	flag.DurationVar(&cfg.auth.refreshTokenTTL, "auth-refresh-token-ttl", 30*24*time.Hour, "Refresh token TTL")
+
+	flag.IntVar(&cfg.login.backoffAfter, "login-backoff-after", 3, "Failed logins for an account before backing off")
+	flag.DurationVar(&cfg.login.maxBackoff, "login-max-backoff", 5*time.Minute, "Maximum wait between failed logins for an account")
+	flag.IntVar(&cfg.login.lockAfter, "login-lock-after", 10, "Failed logins for an account before locking it")
+	flag.DurationVar(&cfg.login.lockDuration, "login-lock-duration", 15*time.Minute, "How long an account stays locked")
+	flag.IntVar(&cfg.login.ipMaxFailures, "login-ip-max-failures", 20, "Failed logins per client IP within the window before blocking it")
+	flag.DurationVar(&cfg.login.ipWindow, "login-ip-window", 15*time.Minute, "Window for counting failed logins per client IP")
+
+	flag.UintVar(&cfg.argon2.memory, "argon2-memory", 64*1024, "Argon2id memory cost in KiB for new password hashes")
+	flag.UintVar(&cfg.argon2.iterations, "argon2-iterations", 3, "Argon2id iterations for new password hashes")
+	flag.UintVar(&cfg.argon2.parallelism, "argon2-parallelism", 2, "Argon2id parallelism for new password hashes")
+
+	flag.StringVar(&cfg.passwords.breachedFile, "breached-passwords-file", "", "Sorted SHA-1 digests of breached passwords to reject (disabled when empty)")
 
 	displayVersion := flag.Bool("version", false, "Display version and exit")
 
@@ -100,6 +191,30 @@ func main() {
 
 	fmt.Printf("cors-trusted-origins=%v\n", cfg.cors.trustedOrigins)
 
+	if cfg.argon2.parallelism < 1 || cfg.argon2.parallelism > 255 || cfg.argon2.iterations < 1 || cfg.argon2.memory < 8*cfg.argon2.parallelism {
+		logger.PrintFatal(errors.New("invalid argon2 parameters"), nil)
+	}
+
+	data.PasswordHashing.Memory = uint32(cfg.argon2.memory)
+	data.PasswordHashing.Iterations = uint32(cfg.argon2.iterations)
+	data.PasswordHashing.Parallelism = uint8(cfg.argon2.parallelism)
+
+	switch cfg.auth.mode {
+	case authModeStateful:
+	case authModeStateless:
+		if len(cfg.auth.signingKey) < 32 {
+			logger.PrintFatal(errors.New("auth-signing-key must be at least 32 bytes long in stateless mode"), nil)
+		}
+	default:
+		logger.PrintFatal(fmt.Errorf("unknown auth-mode %q", cfg.auth.mode), nil)
+	}
+
+	switch cfg.registration.mode {
+	case registrationModeOpen, registrationModeInvite:
+	default:
+		logger.PrintFatal(fmt.Errorf("unknown registration-mode %q", cfg.registration.mode), nil)
+	}
+
 	db, err := openDb(&cfg)
 	if err != nil {
 		logger.PrintFatal(err, nil)
@@ -107,6 +222,22 @@ func main() {
 	defer db.Close()
 	logger.PrintInfo("database connection pool established", nil)
 
+	var breachedPasswords *breached.Corpus
+
+	if cfg.passwords.breachedFile != "" {
+		breachedPasswords, err = breached.Open(cfg.passwords.breachedFile)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		defer breachedPasswords.Close()
+
+		logger.PrintInfo("breached passwords corpus loaded", map[string]string{
+			"passwords": strconv.FormatInt(breachedPasswords.Len(), 10),
+		})
+	}
+
+	models := data.NewModels(db, cfg.permissions.cacheTTL)
+
 	expvar.NewString("version").Set(version)
 	expvar.Publish("goroutines", expvar.Func(func() any {
 		return runtime.NumGoroutine()
@@ -114,16 +245,39 @@ func main() {
 	expvar.Publish("database", expvar.Func(func() any {
 		return db.Stats()
 	}))
+	expvar.Publish("permissions_cache", expvar.Func(func() any {
+		return models.Permissions.CacheStats()
+	}))
 	expvar.Publish("timestamp", expvar.Func(func() any {
 		return time.Now().Unix()
 	}))
 
+	ok, err := models.Roles.Exists(cfg.defaultRole)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	if !ok {
+		logger.PrintFatal(fmt.Errorf("default role %q does not exist", cfg.defaultRole), nil)
+	}
+
 	app := &app{
-		logger:  logger,
-		version: version,
-		config:  cfg,
-		models:  data.NewModels(db),
-		mailer:  mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		logger:            logger,
+		version:           version,
+		config:            cfg,
+		models:            models,
+		mailer:            mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		loginFailures:     newLoginFailures(cfg.login.ipWindow),
+		breachedPasswords: breachedPasswords,
+		sessionActivity:   newSessionActivity(),
+		sessionUsers:      newSessionUsers(),
+		shutdown:          make(chan struct{}),
+	}
+
+	app.flushSessionActivityPeriodically()
+	app.purgeLoginAttempts()
+
+	if cfg.movies.trashRetention > 0 {
+		app.purgeTrashedMovies()
 	}
 
 	if err := app.serve(); err != nil {
@@ -14,6 +14,7 @@ import (
 	"github.com/tomasen/realip"
 	"golang.org/x/time/rate"
 	"goplex.kibonga/internal/data"
+	"goplex.kibonga/internal/jwt"
 	"goplex.kibonga/internal/validator"
 )
 
@@ -100,12 +101,26 @@ func (app *app) authenticate(next http.Handler) http.Handler {
 		authorizationHeader := r.Header.Get("Authorization")
 
 		if authorizationHeader == "" {
+			if app.config.sessions.cookies && !cookielessRoutes[r.Method+" "+r.URL.Path] {
+				w.Header().Add("Vary", "Cookie")
+
+				if cookie, err := r.Cookie(sessionCookieName); err == nil {
+					app.authenticateSessionCookie(next, w, r, cookie.Value)
+					return
+				}
+			}
+
 			r = app.contextSetUser(r, data.AnonymousUser)
 			next.ServeHTTP(w, r)
 			return
 		}
 
 		headerParts := strings.Split(authorizationHeader, " ")
+		if len(headerParts) == 2 && headerParts[0] == "ApiKey" {
+			app.authenticateAPIKey(next, w, r, headerParts[1])
+			return
+		}
+
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
@@ -113,6 +128,45 @@ func (app *app) authenticate(next http.Handler) http.Handler {
 
 		token := headerParts[1]
 
+		if app.config.auth.mode == authModeStateless && jwt.LooksLikeToken(token) {
+			userID, sessionID, err := data.VerifyAccessToken(token, []byte(app.config.auth.signingKey))
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			// The session is still looked up now and then so that logging
+			// out, changing the password or getting suspended don't have to
+			// wait for the access token to expire
+			user, ok := app.sessionUsers.get(sessionID)
+			if !ok {
+				user, err = app.models.Users.GetBySession(userID, sessionID)
+				if err != nil {
+					switch {
+					case errors.Is(err, data.ErrRecordNotFound):
+						app.invalidAuthenticationTokenResponse(w, r)
+					default:
+						app.serverErrorResponse(w, r, err)
+					}
+					return
+				}
+
+				app.sessionUsers.set(sessionID, user)
+			}
+
+			if user.Id != userID {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			r = app.contextSetUser(r, user)
+			r = app.contextSetToken(r, token)
+			r = app.contextSetSessionID(r, sessionID)
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		v := validator.New()
 		data.ValidatePlaintextToken(v, token)
 
@@ -121,7 +175,7 @@ func (app *app) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
-		user, err := app.models.Users.GetByToken(data.ScopeAuthentication, token)
+		user, impersonatorID, err := app.models.Users.GetByAuthenticationToken(token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -132,12 +186,115 @@ func (app *app) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		if impersonatorID != 0 {
+			app.serveImpersonation(next, w, r, user, impersonatorID, token)
+			return
+		}
+
+		app.sessionActivity.touch(token)
+
 		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, token)
 
 		next.ServeHTTP(w, r)
 	})
 }
 
+func (app *app) authenticateSessionCookie(next http.Handler, w http.ResponseWriter, r *http.Request, token string) {
+	// Browsers attach the cookie to requests made by any site, so whatever
+	// could change state must also prove it can read the CSRF token
+	if !validCSRFToken(r) {
+		app.invalidCSRFTokenResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	data.ValidatePlaintextToken(v, token)
+
+	if !v.Valid() {
+		app.invalidSessionCookieResponse(w, r)
+		return
+	}
+
+	user, err := app.models.Users.GetByToken(data.ScopeAuthentication, token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidSessionCookieResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.sessionActivity.touch(token)
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetToken(r, token)
+	r = app.contextSetCookieSession(r)
+
+	next.ServeHTTP(w, r)
+}
+
+// serveImpersonation serves requests made with an impersonation token, each of
+// which ends up in the audit log along with its response status.
+func (app *app) serveImpersonation(next http.Handler, w http.ResponseWriter, r *http.Request, user *data.User, impersonatorID int64, token string) {
+	r = app.contextSetUser(r, user)
+	r = app.contextSetToken(r, token)
+	r = app.contextSetImpersonatorID(r, impersonatorID)
+
+	metrics := httpsnoop.CaptureMetrics(next, w, r)
+
+	err := app.models.AuditLog.Insert(&data.AuditEntry{
+		UserID:         user.Id,
+		ImpersonatorID: impersonatorID,
+		Method:         r.Method,
+		Path:           r.URL.RequestURI(),
+		Status:         metrics.Code,
+		IP:             realip.FromRequest(r),
+	})
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+func (app *app) authenticateAPIKey(next http.Handler, w http.ResponseWriter, r *http.Request, plaintext string) {
+	v := validator.New()
+	data.ValidatePlaintextAPIKey(v, plaintext)
+
+	if !v.Valid() {
+		app.invalidAPIKeyResponse(w, r)
+		return
+	}
+
+	key, err := app.models.APIKeys.GetByPlaintext(plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAPIKeyResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(key.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAPIKeyResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetAPIKey(r, key)
+
+	next.ServeHTTP(w, r)
+}
+
 func (app *app) requireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
 	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
@@ -154,7 +311,7 @@ func (app *app) requireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return app.requireAuthenticatedUser(fn)
 }
 
-func (app *app) requireAuthenticatedUser(next http.Handler) http.HandlerFunc {
+func (app *app) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
 
@@ -163,21 +320,52 @@ func (app *app) requireAuthenticatedUser(next http.Handler) http.HandlerFunc {
 			return
 		}
 
+		if user.Suspended {
+			app.suspendedAccountResponse(w, r)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
 
-func (app *app) requirePermissions(code string, next http.HandlerFunc) http.HandlerFunc {
+// requireAuthenticationToken is for account management resources, which must
+// not be reachable with an API key even when the key's owner could use them.
+func (app *app) requireAuthenticationToken(next http.HandlerFunc) http.HandlerFunc {
 	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		user := app.contextGetUser(r)
+		if app.contextGetAPIKey(r) != nil {
+			app.apiKeyNotAllowedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+
+	return app.requireAuthenticatedUser(fn)
+}
+
+// requireNoImpersonation guards actions that only the user themselves may
+// take, like changing their credentials.
+func (app *app) requireNoImpersonation(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetImpersonatorID(r) != 0 {
+			app.impersonationNotAllowedResponse(w, r)
+			return
+		}
 
-		permissions, err := app.models.Permissions.GetAllForUser(user.Id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (app *app) requirePermissions(code string, next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, err := app.hasPermission(r, code)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
 		}
 
-		if !permissions.Include(code) {
+		if !ok {
 			app.notPermittedResponse(w, r)
 			return
 		}
@@ -188,6 +376,25 @@ func (app *app) requirePermissions(code string, next http.HandlerFunc) http.Hand
 	return app.requireActivatedUser(fn)
 }
 
+// hasPermission reports whether the user may use the permission code, which
+// with an API key also takes the key granting it.
+func (app *app) hasPermission(r *http.Request, code string) (bool, error) {
+	permissions, err := app.models.Permissions.GetAllForUser(app.contextGetUser(r).Id)
+	if err != nil {
+		return false, err
+	}
+
+	if !permissions.Include(code) {
+		return false, nil
+	}
+
+	if key := app.contextGetAPIKey(r); key != nil && !key.Permissions.Include(code) {
+		return false, nil
+	}
+
+	return true, nil
+}
+
 func (app *app) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Vary", "Origin")
@@ -199,6 +406,14 @@ func (app *app) enableCORS(next http.Handler) http.Handler {
 		if origin != "" && app.includes(origin, app.config.cors.trustedOrigins) {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 
+			// Scripts need the ETag to make their changes conditional
+			w.Header().Set("Access-Control-Expose-Headers", "ETag")
+
+			// Only ever sent alongside a specific trusted origin, never with *
+			if app.config.cors.allowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+
 			fmt.Println("This is inside origin")
 
 			// Check if request is a preflight request
@@ -207,7 +422,7 @@ func (app *app) enableCORS(next http.Handler) http.Handler {
 			// 3. has access-control-request-method header
 			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
 				w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match, "+csrfHeaderName)
 
 				fmt.Println("This is inside preflight")
 
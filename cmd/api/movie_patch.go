@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"goplex.kibonga/internal/data"
+	"goplex.kibonga/internal/patch"
+)
+
+const (
+	mediaTypeMergePatch = "application/merge-patch+json"
+	mediaTypeJSONPatch  = "application/json-patch+json"
+)
+
+// movieDocument is the representation of a movie that patches are applied to.
+// Its members are named like in the representation GET returns, so the year is
+// released. A patched version is taken as the version the client edited, not
+// as a change.
+type movieDocument struct {
+	Title   string       `json:"title"`
+	Year    int32        `json:"released"`
+	Runtime data.Runtime `json:"runtime"`
+	Genres  []string     `json:"genres"`
+	Version int32        `json:"version"`
+}
+
+func mediaType(r *http.Request) string {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return ""
+	}
+
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+
+	return mt
+}
+
+// patchMovie applies the merge patch or JSON Patch in the request body to
+// movie. It returns the version the patch says it was made against, nil when
+// the patch doesn't mention the version.
+func (app *app) patchMovie(w http.ResponseWriter, r *http.Request, movie *data.Movie) (*int32, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1_048_576))
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return nil, false
+	}
+
+	if len(body) == 0 {
+		app.badRequestResponse(w, r, errors.New("body must not be empty"))
+		return nil, false
+	}
+
+	doc, err := json.Marshal(movieDocument{
+		Title:   movie.Title,
+		Year:    movie.Year,
+		Runtime: movie.Runtime,
+		Genres:  movie.Genres,
+		Version: movie.Version,
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	var patched []byte
+
+	if mediaType(r) == mediaTypeMergePatch {
+		patched, err = patch.Merge(doc, body)
+	} else {
+		patched, err = patch.Apply(doc, body)
+	}
+	if err != nil {
+		var testErr *patch.TestFailedError
+
+		switch {
+		// Testing the version is how a JSON Patch makes itself conditional
+		case errors.As(err, &testErr) && testErr.Path == "/version":
+			app.preconditionFailedResponse(w, r)
+		case errors.Is(err, patch.ErrTestFailed):
+			app.patchTestFailedResponse(w, r, err)
+		case errors.Is(err, patch.ErrInvalidPatch), errors.Is(err, patch.ErrPathNotFound):
+			app.badRequestResponse(w, r, err)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	var result movieDocument
+
+	dec := json.NewDecoder(bytes.NewReader(patched))
+	dec.DisallowUnknownFields()
+
+	err = dec.Decode(&result)
+	if err != nil {
+		app.badRequestResponse(w, r, fmt.Errorf("patch results in an invalid movie: %w", err))
+		return nil, false
+	}
+
+	movie.Title = result.Title
+	movie.Year = result.Year
+	movie.Runtime = result.Runtime
+	movie.Genres = result.Genres
+
+	if !mentionsVersion(r, body) {
+		return nil, true
+	}
+
+	return &result.Version, true
+}
+
+// mentionsVersion reports whether a patch body refers to the version member,
+// which makes it a precondition.
+func mentionsVersion(r *http.Request, body []byte) bool {
+	if mediaType(r) == mediaTypeMergePatch {
+		var members map[string]json.RawMessage
+		if json.Unmarshal(body, &members) != nil {
+			return false
+		}
+
+		_, ok := members["version"]
+		return ok
+	}
+
+	var ops []patch.Operation
+	if json.Unmarshal(body, &ops) != nil {
+		return false
+	}
+
+	for _, op := range ops {
+		if op.Path == "/version" {
+			return true
+		}
+	}
+
+	return false
+}
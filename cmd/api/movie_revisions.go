@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"goplex.kibonga/internal/data"
+	"goplex.kibonga/internal/validator"
+)
+
+func validRevisionSortVals() *[]string {
+	return &[]string{"version", "created_at", "-version", "-created_at"}
+}
+
+// checkMovieRevisionsVisible sends a 404 for the revisions of a movie that is
+// in the trash or purged, unless the caller administers movies. Revisions
+// outlive their movie, but shouldn't show it to those who can't see the trash.
+func (app *app) checkMovieRevisionsVisible(w http.ResponseWriter, r *http.Request, id int64) bool {
+	_, err := app.models.Movies.Get(int(id))
+	if err == nil {
+		return true
+	}
+
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	ok, err := app.hasPermission(r, "movies:admin")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !ok {
+		app.notFoundResponse(w, r)
+		return false
+	}
+
+	return true
+}
+
+func (app *app) listMovieRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIdParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	filters := &data.Filters{}
+	urlVals := r.URL.Query()
+
+	v := validator.New()
+
+	filters.PageSize = app.readInt(urlVals, "page_size", v, 20)
+	filters.Page = app.readInt(urlVals, "page", v, 1)
+	filters.Sort = app.readStr(urlVals, "sort", "-version")
+	filters.ValidSortValues = *validRevisionSortVals()
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.checkMovieRevisionsVisible(w, r, id) {
+		return
+	}
+
+	revisions, metadata, err := app.models.MovieRevisions.GetAllForMovie(id, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Every movie has revisions from the moment it is added, so movies
+	// without any have never existed
+	if metadata.TotalRecords == 0 && filters.Page == 1 {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.writeJson(w, http.StatusOK, payload{"revisions": revisions, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readMovieRevision looks up the revision named by the :id and :version
+// parameters, sending a 404 when there is none.
+func (app *app) readMovieRevision(w http.ResponseWriter, r *http.Request) (*data.MovieRevision, bool) {
+	id, err := app.readIdParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	version, err := app.readVersionParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	if !app.checkMovieRevisionsVisible(w, r, id) {
+		return nil, false
+	}
+
+	rev, err := app.models.MovieRevisions.Get(id, version)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return rev, true
+}
+
+func (app *app) showMovieRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	rev, ok := app.readMovieRevision(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeJson(w, http.StatusOK, payload{"revision": rev}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) rollBackMovieHandler(w http.ResponseWriter, r *http.Request) {
+	rev, ok := app.readMovieRevision(w, r)
+	if !ok {
+		return
+	}
+
+	if rev.Action == data.RevisionDelete {
+		app.badRequestResponse(w, r, errors.New("can't roll back to a deletion, delete the movie instead"))
+		return
+	}
+
+	movie, err := app.models.Movies.Get(int(rev.MovieID))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	conditional, ok := app.checkMoviePreconditions(w, r, movie, nil)
+	if !ok {
+		return
+	}
+
+	err = app.models.Movies.RollBack(movie, rev, app.contextGetUser(r).Id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict) && conditional:
+			app.preconditionFailedResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	setMovieValidators(headers, movie)
+
+	err = app.writeJson(w, http.StatusOK, payload{"movie": movie}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -25,6 +25,7 @@ type MovieUpdateRequest struct {
 	Year    *int32        `json:"year"`
 	Runtime *data.Runtime `json:"runtime"`
 	Genres  []string      `json:"genres"`
+	Version *int32        `json:"version"`
 }
 
 type ListMoviesRequest struct {
@@ -37,29 +38,40 @@ func listMoviesReq() *ListMoviesRequest {
 	return &ListMoviesRequest{Filters: &data.Filters{}}
 }
 
-// func (app *app) showMovieHandler(w http.ResponseWriter, r *http.Request) {
-// 	id, err := app.readIdParam(r)
-// 	if err != nil {
-// 		app.notFoundResponse(w, r)
-// 		return
-// 	}
-
-// 	movie, err := app.models.Movies.Get(int(id))
-// 	if err != nil {
-// 		switch {
-// 		case errors.Is(err, data.ErrRecordNotFound):
-// 			app.notFoundResponse(w, r)
-// 		default:
-// 			app.serverErrorResponse(w, r, err)
-// 		}
-// 		return
-// 	}
-
-// 	if err := app.writeJsonToStream(w, http.StatusOK, payload{"movie": movie}, nil); err != nil {
-// 		app.serverErrorResponse(w, r, err)
-// 		return
-// 	}
-// }
+func (app *app) showMovieHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIdParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	movie, err := app.models.Movies.Get(int(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	setMovieValidators(headers, movie)
+
+	if notModified(r, movie) {
+		for k, v := range headers {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	err = app.writeJson(w, http.StatusOK, payload{"movie": movie}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
 
 func (app *app) createMovieHandler(w http.ResponseWriter, r *http.Request) {
 	var req MovieCreateRequest
@@ -85,7 +97,7 @@ func (app *app) createMovieHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = app.models.Movies.Insert(&movie)
+	err = app.models.Movies.Insert(&movie, app.contextGetUser(r).Id)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -93,6 +105,7 @@ func (app *app) createMovieHandler(w http.ResponseWriter, r *http.Request) {
 
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.Id))
+	setMovieValidators(headers, &movie)
 
 	err = app.writeJson(w, http.StatusCreated, payload{"movie": movie}, headers)
 	if err != nil {
@@ -144,26 +157,49 @@ func (app *app) updateMovieHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req MovieUpdateRequest
-	err = app.decodeJson(r, &req)
-	if err != nil {
-		app.badRequestResponse(w, r, err)
-	}
+	var version *int32
 
-	if req.Title != nil {
-		movie.Title = *req.Title
-	}
+	switch mediaType(r) {
+	case mediaTypeMergePatch, mediaTypeJSONPatch:
+		var ok bool
 
-	if req.Year != nil {
-		movie.Year = *req.Year
-	}
+		version, ok = app.patchMovie(w, r, movie)
+		if !ok {
+			return
+		}
+	case "", "application/json":
+		var req MovieUpdateRequest
+		err = app.decodeJson(r, &req)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
 
-	if req.Runtime != nil {
-		movie.Runtime = *req.Runtime
+		if req.Title != nil {
+			movie.Title = *req.Title
+		}
+
+		if req.Year != nil {
+			movie.Year = *req.Year
+		}
+
+		if req.Runtime != nil {
+			movie.Runtime = *req.Runtime
+		}
+
+		if req.Genres != nil {
+			movie.Genres = req.Genres
+		}
+
+		version = req.Version
+	default:
+		app.unsupportedMediaTypeResponse(w, r)
+		return
 	}
 
-	if req.Genres != nil {
-		movie.Genres = req.Genres
+	conditional, ok := app.checkMoviePreconditions(w, r, movie, version)
+	if !ok {
+		return
 	}
 
 	validator := validator.New()
@@ -173,9 +209,13 @@ func (app *app) updateMovieHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = app.models.Movies.Update(movie)
+	err = app.models.Movies.Update(movie, app.contextGetUser(r).Id)
 	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict) && conditional:
+			app.preconditionFailedResponse(w, r)
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
 		default:
@@ -186,6 +226,7 @@ func (app *app) updateMovieHandler(w http.ResponseWriter, r *http.Request) {
 
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("v1/movies/%d", movie.Id))
+	setMovieValidators(headers, movie)
 
 	err = app.writeJson(w, http.StatusOK, payload{"movie": movie}, headers)
 	if err != nil {
@@ -200,11 +241,46 @@ func (app *app) deleteMovieHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = app.models.Movies.Delete(int(id))
+	movie, err := app.models.Movies.Get(int(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// DELETE has no body, so the version comes in the query string
+	var version *int32
+
+	if urlVals := r.URL.Query(); urlVals.Has("version") {
+		v := validator.New()
+
+		n := int32(app.readInt(urlVals, "version", v, 0))
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		version = &n
+	}
+
+	conditional, ok := app.checkMoviePreconditions(w, r, movie, version)
+	if !ok {
+		return
+	}
+
+	err = app.models.Movies.Delete(movie.Id, movie.Version, app.contextGetUser(r).Id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict) && conditional:
+			app.preconditionFailedResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"goplex.kibonga/internal/data"
+	"goplex.kibonga/internal/validator"
+)
+
+func validTrashSortVals() *[]string {
+	return &[]string{"id", "title", "deleted_at", "-id", "-title", "-deleted_at"}
+}
+
+func (app *app) listTrashedMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	filters := &data.Filters{}
+	urlVals := r.URL.Query()
+
+	v := validator.New()
+
+	filters.PageSize = app.readInt(urlVals, "page_size", v, 20)
+	filters.Page = app.readInt(urlVals, "page", v, 1)
+	filters.Sort = app.readStr(urlVals, "sort", "-deleted_at")
+	filters.ValidSortValues = *validTrashSortVals()
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movies, metadata, err := app.models.Movies.GetAllTrashed(filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, http.StatusOK, payload{"movies": movies, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) restoreMovieHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIdParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	movie, err := app.models.Movies.Restore(id, app.contextGetUser(r).Id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	setMovieValidators(headers, movie)
+
+	err = app.writeJson(w, http.StatusOK, payload{"movie": movie}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// purgeTrashedMovies permanently removes the movies that have been in the
+// trash for longer than the retention period, right away and then once an
+// hour until shutdown.
+func (app *app) purgeTrashedMovies() {
+	app.background(func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+
+		for {
+			purged, err := app.models.Movies.Purge(time.Now().Add(-app.config.movies.trashRetention))
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			} else if purged > 0 {
+				app.logger.PrintInfo("purged trashed movies", map[string]string{
+					"movies": strconv.FormatInt(purged, 10),
+				})
+			}
+
+			select {
+			case <-ticker.C:
+			case <-app.shutdown:
+				return
+			}
+		}
+	})
+}
@@ -15,23 +15,85 @@ func (app *app) routes() http.Handler {
 
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healtcheckHandler)
 
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermissions("movies:read", app.listMoviesHandler))
+	// httprouter doesn't allow static routes like /v1/movies/trash next to the
+	// /v1/movies/:id wildcard for the same method, so they hang off the wildcard
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", staticOr("trash",
+		app.requirePermissions("movies:admin", app.listTrashedMoviesHandler),
+		app.requirePermissions("movies:read", app.showMovieHandler)))
 	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermissions("movies:write", app.createMovieHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/movies/bytes", app.requirePermissions("movies:write", app.createMovieHandlerMarshal))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id", staticOr("bytes",
+		app.requirePermissions("movies:write", app.createMovieHandlerMarshal),
+		app.notFoundResponse))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/restore", app.requirePermissions("movies:admin", app.restoreMovieHandler))
 	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermissions("movies:write", app.updateMovieHandler))
 	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermissions("movies:write", app.deleteMovieHandler))
 	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermissions("movies:read", app.listMoviesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/revisions", app.requirePermissions("movies:read", app.listMovieRevisionsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/revisions/:version", app.requirePermissions("movies:read", app.showMovieRevisionHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/revisions/:version/rollback", app.requirePermissions("movies:write", app.rollBackMovieHandler))
 
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/me", app.requireAuthenticationToken(app.showCurrentUserHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me", app.requireAuthenticationToken(app.requireNoImpersonation(app.updateCurrentUserHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/email", app.requireAuthenticationToken(app.requireNoImpersonation(app.requestEmailChangeHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/email", app.requireAuthenticationToken(app.requireNoImpersonation(app.confirmEmailChangeHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/sessions", app.requireAuthenticationToken(app.listSessionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/sessions/:id", app.requireAuthenticationToken(app.requireNoImpersonation(app.deleteSessionHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/2fa", app.requireAuthenticationToken(app.showTwoFactorHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/2fa", app.requireAuthenticationToken(app.requireNoImpersonation(app.enrollTwoFactorHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/2fa", app.requireAuthenticationToken(app.requireNoImpersonation(app.confirmTwoFactorHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/2fa", app.requireAuthenticationToken(app.requireNoImpersonation(app.deleteTwoFactorHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/api-keys", app.requireAuthenticationToken(app.listAPIKeysHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/api-keys", app.requireAuthenticationToken(app.requireNoImpersonation(app.createAPIKeyHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/api-keys/:id", app.requireAuthenticationToken(app.requireNoImpersonation(app.deleteAPIKeyHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users", app.requirePermissions("users:admin", app.listUsersHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id", app.requirePermissions("users:admin", app.showUserHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/admin/users/:id", app.requirePermissions("users:admin", app.updateUserStatusHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/permissions", app.requirePermissions("users:admin", app.grantUserPermissionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/permissions", app.requirePermissions("users:admin", app.revokeUserPermissionsHandler))
+
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/impersonation", app.requirePermissions("users:admin", app.requireNoImpersonation(app.createImpersonationTokenHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/audit-log", app.requirePermissions("users:admin", app.listAuditLogHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/invitations", app.requirePermissions("users:admin", app.listInvitationsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/invitations", app.requirePermissions("users:admin", app.createInvitationHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/invitations/:id", app.requirePermissions("users:admin", app.deleteInvitationHandler))
 
 	router.HandlerFunc(http.MethodGet, "/v1/foo", app.fooHandler)
 	router.HandlerFunc(http.MethodGet, "/v1/foo/permissions", app.fooPermissionsHandlerGetAllForUser)
 	router.HandlerFunc(http.MethodPost, "/v1/tokens", app.tokenHandler)
 
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthTokenHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireAuthenticationToken(app.deleteAuthTokenHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication/all", app.requireAuthenticationToken(app.requireNoImpersonation(app.deleteAllAuthTokensHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication/2fa", app.createTwoFactorAuthTokenHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/tokens/csrf", app.requireAuthenticationToken(app.showCSRFTokenHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.refreshAuthTokenHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/refresh", app.requireAuthenticationToken(app.requireNoImpersonation(app.deleteRefreshTokenHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/magic-login", app.createMagicLoginTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/magic-login/authentication", app.createMagicLoginAuthTokenHandler)
 
 	router.Handler(http.MethodGet, "/v1/metrics", expvar.Handler())
 
 	return app.metrics(app.recoverPanic(app.enableCORS(app.limitRate(app.authenticate(router)))))
 }
+
+// staticOr serves static when the :id parameter is segment, and wildcard
+// otherwise.
+func staticOr(segment string, static, wildcard http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if httprouter.ParamsFromContext(r.Context()).ByName("id") == segment {
+			static(w, r)
+			return
+		}
+
+		wildcard(w, r)
+	}
+}
@@ -47,6 +47,9 @@ func (app *app) serve() error {
 			"addr": srv.Addr,
 		})
 
+		// Tells long running background tasks to wrap up
+		close(app.shutdown)
+
 		app.wg.Wait()
 		shutdownError <- nil
 	}()
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"goplex.kibonga/internal/data"
+)
+
+type Session struct {
+	Id         int64     `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	Expiry     time.Time `json:"expiry"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	Current    bool      `json:"current"`
+}
+
+// sessionActivity buffers the last time each authentication token was seen,
+// so that authenticate doesn't have to write to the database on every request.
+type sessionActivity struct {
+	mu       sync.Mutex
+	lastUsed map[string]time.Time
+}
+
+func newSessionActivity() *sessionActivity {
+	return &sessionActivity{lastUsed: make(map[string]time.Time)}
+}
+
+func (s *sessionActivity) touch(token string) {
+	s.mu.Lock()
+	s.lastUsed[token] = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *sessionActivity) drain() map[string]time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lastUsed := s.lastUsed
+	s.lastUsed = make(map[string]time.Time)
+
+	return lastUsed
+}
+
+// sessionUsers keeps the user behind each signed access token's session for a
+// little while, so that authenticate doesn't go to the database on every
+// request. Revoking sessions or changing a user's status here forgets their
+// entries right away, anywhere else it takes effect within sessionUsersTTL.
+type sessionUsers struct {
+	mu    sync.Mutex
+	users map[int64]cachedSessionUser
+}
+
+type cachedSessionUser struct {
+	user    *data.User
+	expires time.Time
+}
+
+const sessionUsersTTL = 30 * time.Second
+
+func newSessionUsers() *sessionUsers {
+	return &sessionUsers{users: make(map[int64]cachedSessionUser)}
+}
+
+func (s *sessionUsers) get(sessionID int64) (*data.User, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.users[sessionID]
+	if !ok || time.Now().After(c.expires) {
+		return nil, false
+	}
+
+	return c.user, true
+}
+
+func (s *sessionUsers) set(sessionID int64, user *data.User) {
+	s.mu.Lock()
+	s.users[sessionID] = cachedSessionUser{user: user, expires: time.Now().Add(sessionUsersTTL)}
+	s.mu.Unlock()
+}
+
+func (s *sessionUsers) forgetUser(userID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for sessionID, c := range s.users {
+		if c.user.Id == userID {
+			delete(s.users, sessionID)
+		}
+	}
+}
+
+func (s *sessionUsers) prune() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	for sessionID, c := range s.users {
+		if now.After(c.expires) {
+			delete(s.users, sessionID)
+		}
+	}
+}
+
+func (app *app) flushSessionActivity() {
+	for token, lastUsedAt := range app.sessionActivity.drain() {
+		err := app.models.Tokens.UpdateLastUsed(token, lastUsedAt)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	}
+}
+
+// flushSessionActivityPeriodically writes the buffered activity every minute,
+// and one last time on shutdown so none of it is lost. Expired session users
+// are dropped along the way.
+func (app *app) flushSessionActivityPeriodically() {
+	app.background(func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				app.flushSessionActivity()
+				app.sessionUsers.prune()
+			case <-app.shutdown:
+				app.flushSessionActivity()
+				return
+			}
+		}
+	})
+}
+
+func (app *app) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	current := app.contextGetToken(r)
+	currentID := app.contextGetSessionID(r)
+
+	tokens, err := app.models.Tokens.GetSessionsForUser(user.Id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	sessions := make([]*Session, 0, len(tokens))
+
+	for _, t := range tokens {
+		sessions = append(sessions, &Session{
+			Id:         t.Id,
+			CreatedAt:  t.CreatedAt,
+			LastUsedAt: t.LastUsedAt,
+			Expiry:     t.Expiry,
+			UserAgent:  t.UserAgent,
+			IP:         t.IP,
+			Current:    t.Id == currentID || t.MatchesPlaintext(current),
+		})
+	}
+
+	err = app.writeJson(w, http.StatusOK, payload{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIdParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.models.Tokens.DeleteSessionForUser(id, user.Id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.sessionUsers.forgetUser(user.Id)
+
+	err = app.writeJson(w, http.StatusOK, payload{"message": "session successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
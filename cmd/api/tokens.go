@@ -5,7 +5,9 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/tomasen/realip"
 	"goplex.kibonga/internal/data"
+	"goplex.kibonga/internal/jwt"
 	"goplex.kibonga/internal/validator"
 )
 
@@ -32,39 +34,513 @@ func (app *app) createAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if user exist and fetch user from DB
+	if !app.checkLoginAllowed(w, r, req.Email) {
+		return
+	}
+
+	// Unknown emails go through the same steps as wrong passwords, so neither
+	// the response nor its timing tells which emails are registered
 	user, err := app.models.Users.GetByEmail(req.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var ok bool
+
+	if user != nil {
+		ok, err = user.Password.Matches(req.Password)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	} else {
+		data.MatchesNoPassword(req.Password)
+	}
+
+	if !ok {
+		err = app.recordLoginFailure(r, req.Email, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	if user.Suspended {
+		app.suspendedAccountResponse(w, r)
+		return
+	}
+
+	// This is the only time the plaintext is at hand, so it's when legacy and
+	// outdated hashes get moved over. A failure here mustn't fail the login
+	if user.Password.NeedsRehash() {
+		err = user.Password.Set(req.Password)
+		if err == nil {
+			err = app.models.Users.Update(user)
+		}
+		if err != nil {
+			app.logError(r, err)
+		}
+	}
+
+	app.completeLogin(w, r, user)
+}
+
+// writeAuthTokens issues the tokens for a user who just proved who they are and
+// sends them back. In stateless mode that is a signed access token and a
+// refresh token, otherwise a single authentication token. Browser clients can
+// ask for a session cookie instead.
+func (app *app) writeAuthTokens(w http.ResponseWriter, r *http.Request, user *data.User) {
+	if app.wantsSessionCookie(r) {
+		app.writeSessionCookie(w, r, user)
+		return
+	}
+
+	if app.config.auth.mode != authModeStateless {
+		token, err := app.models.Tokens.New(user.Id, 24*time.Hour, data.ScopeAuthentication, data.Client{UserAgent: r.UserAgent(), IP: realip.FromRequest(r)})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeJson(w, http.StatusOK, payload{"authentication_token": token}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	refreshToken, err := app.models.Tokens.New(user.Id, app.config.auth.refreshTokenTTL, data.ScopeRefresh, data.Client{UserAgent: r.UserAgent(), IP: realip.FromRequest(r)})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	accessToken, err := data.NewAccessToken(user, refreshToken.Id, app.config.auth.accessTokenTTL, []byte(app.config.auth.signingKey))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, http.StatusOK, payload{"authentication_token": accessToken, "refresh_token": refreshToken}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) refreshAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := app.decodeJson(r, &req)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidatePlaintextToken(v, req.RefreshToken)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByToken(data.ScopeRefresh, req.RefreshToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidRefreshTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Refresh tokens are rotated on every use. Whoever loses a race to use the
+	// same token twice gets nothing
+	err = app.models.Tokens.Delete(data.ScopeRefresh, req.RefreshToken)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			app.notFoundResponse(w, r)
+			app.invalidRefreshTokenResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	// Validate user creds (password and email)
-	ok, err := user.Password.Matches(req.Password)
+	if user.Suspended {
+		app.suspendedAccountResponse(w, r)
+		return
+	}
+
+	app.writeAuthTokens(w, r, user)
+}
+
+func (app *app) deleteRefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := app.decodeJson(r, &req)
 	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidatePlaintextToken(v, req.RefreshToken)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByToken(data.ScopeRefresh, req.RefreshToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidRefreshTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Id != app.contextGetUser(r).Id {
+		app.invalidRefreshTokenResponse(w, r)
+		return
+	}
+
+	err = app.models.Tokens.Delete(data.ScopeRefresh, req.RefreshToken)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	if !ok {
-		app.invalidCredentialsResponse(w, r)
+	app.sessionUsers.forgetUser(user.Id)
+
+	err = app.writeJson(w, http.StatusOK, payload{"message": "refresh token revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+
+	err := app.decodeJson(r, &req)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateEmail(v, req.Email)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	// Create new token
-	token, err := app.models.Tokens.New(user.Id, 24*time.Hour, data.ScopeAuthentication)
+	// Lookup and mailing happen in the background so the response is the
+	// same whether or not the email belongs to a registered user
+	app.background(func() {
+		user, err := app.models.Users.GetByEmail(req.Email)
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				app.logger.PrintError(err, nil)
+			}
+			return
+		}
+
+		token, err := app.models.Tokens.New(user.Id, 45*time.Minute, data.ScopePasswordReset)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		data := map[string]interface{}{
+			"passwordResetToken": token.PlainText,
+		}
+
+		err = app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	message := "an email will be sent to you containing password reset instructions"
+
+	err = app.writeJson(w, http.StatusAccepted, payload{"message": message}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+
+	err := app.decodeJson(r, &req)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateEmail(v, req.Email)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Unknown and already activated users get the same answer as everyone
+	// else, so the endpoint can't be used to probe for registered emails
+	app.background(func() {
+		user, err := app.models.Users.GetByEmail(req.Email)
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				app.logger.PrintError(err, nil)
+			}
+			return
+		}
+
+		if user.Activated {
+			return
+		}
+
+		err = app.models.Tokens.DeleteTokensForUser(data.ScopeActivation, user.Id)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		token, err := app.models.Tokens.New(user.Id, 3*24*time.Hour, data.ScopeActivation)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		data := map[string]interface{}{
+			"activationToken": token.PlainText,
+		}
+
+		err = app.mailer.Send(user.Email, "token_activation.tmpl", data)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	message := "an email will be sent to you containing activation instructions"
+
+	err = app.writeJson(w, http.StatusAccepted, payload{"message": message}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) createMagicLoginTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+
+	err := app.decodeJson(r, &req)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateEmail(v, req.Email)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Same as for password resets, the answer doesn't depend on whether the
+	// email belongs to anyone
+	app.background(func() {
+		user, err := app.models.Users.GetByEmail(req.Email)
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				app.logger.PrintError(err, nil)
+			}
+			return
+		}
+
+		if user.Suspended {
+			return
+		}
+
+		token, err := app.models.Tokens.New(user.Id, 15*time.Minute, data.ScopeMagicLogin)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		data := map[string]interface{}{
+			"magicLoginToken": token.PlainText,
+		}
+
+		err = app.mailer.Send(user.Email, "token_magic_login.tmpl", data)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	message := "an email will be sent to you containing a login link"
+
+	err = app.writeJson(w, http.StatusAccepted, payload{"message": message}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) createMagicLoginAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+
+	err := app.decodeJson(r, &req)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
 		return
 	}
 
-	// Send back auth token as json response
-	err = app.writeJson(w, http.StatusOK, payload{"authentication_token": token}, nil)
+	v := validator.New()
+	data.ValidatePlaintextToken(v, req.Token)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByToken(data.ScopeMagicLogin, req.Token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired login token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Login links are no way around a locked account
+	if !app.checkLoginAllowed(w, r, user.Email) {
+		return
+	}
+
+	// Login links are single use, whoever loses a race for the same link gets
+	// nothing
+	err = app.models.Tokens.Delete(data.ScopeMagicLogin, req.Token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired login token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Suspended {
+		app.suspendedAccountResponse(w, r)
+		return
+	}
+
+	// Following the link proves the user owns the email, which is all that
+	// activation asks for
+	if !user.Activated {
+		user.Activated = true
+
+		err = app.models.Users.Update(user)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.editConflictResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		err = app.models.Tokens.DeleteTokensForUser(data.ScopeActivation, user.Id)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.sessionUsers.forgetUser(user.Id)
+	}
+
+	app.completeLogin(w, r, user)
+}
+
+func (app *app) deleteAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	token := app.contextGetToken(r)
+
+	if jwt.LooksLikeToken(token) {
+		app.badRequestResponse(w, r, errors.New("signed access tokens expire on their own, revoke the refresh token instead"))
+		return
+	}
+
+	// Impersonation tokens are revoked the same way, which ends the
+	// impersonation
+	scope := data.ScopeAuthentication
+	if app.contextGetImpersonatorID(r) != 0 {
+		scope = data.ScopeImpersonation
+	}
+
+	err := app.models.Tokens.Delete(scope, token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if app.contextIsCookieSession(r) {
+		app.clearSessionCookies(w)
+	}
+
+	err = app.writeJson(w, http.StatusOK, payload{"message": "authentication token revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) deleteAllAuthTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.models.Tokens.DeleteSessionsForUser(user.Id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.sessionUsers.forgetUser(user.Id)
+
+	if app.contextIsCookieSession(r) {
+		app.clearSessionCookies(w)
+	}
+
+	err = app.writeJson(w, http.StatusOK, payload{"message": "all authentication tokens revoked"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
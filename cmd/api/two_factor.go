@@ -0,0 +1,335 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"goplex.kibonga/internal/data"
+	"goplex.kibonga/internal/totp"
+	"goplex.kibonga/internal/validator"
+)
+
+const totpIssuer = "GOPLEX"
+
+// completeLogin is called once a user has proved their first factor. Users with
+// two-factor authentication get a short-lived challenge token to exchange at
+// POST /v1/tokens/authentication/2fa, everyone else gets their tokens.
+func (app *app) completeLogin(w http.ResponseWriter, r *http.Request, user *data.User) {
+	enabled, err := app.models.TOTP.IsEnabled(user.Id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Failed logins are only cleared once the last factor is passed, or
+	// anyone with the password could keep guessing codes without ever
+	// locking the account
+	if !enabled {
+		err = app.recordLoginSuccess(user.Email)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.writeAuthTokens(w, r, user)
+		return
+	}
+
+	challenge, err := app.models.Tokens.New(user.Id, 5*time.Minute, data.ScopeTwoFactor)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, http.StatusAccepted, payload{"two_factor_required": true, "challenge_token": challenge}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// verifyTOTPCode checks a code from the user's authenticator app, a code is
+// only accepted once.
+func (app *app) verifyTOTPCode(userID int64, code string) (bool, error) {
+	t, err := app.models.TOTP.GetForUser(userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	step, ok := totp.Validate(t.Secret, code, time.Now(), 1)
+	if !ok {
+		return false, nil
+	}
+
+	return app.models.TOTP.UseStep(userID, step)
+}
+
+func (app *app) createTwoFactorAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+	}
+
+	err := app.decodeJson(r, &req)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidatePlaintextToken(v, req.ChallengeToken)
+	v.Check(req.Code != "" || req.RecoveryCode != "", "code", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByToken(data.ScopeTwoFactor, req.ChallengeToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("challenge_token", "invalid or expired challenge token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.checkLoginAllowed(w, r, user.Email) {
+		return
+	}
+
+	// A challenge is good for a single attempt, so guessing codes means going
+	// through the password check every time
+	err = app.models.Tokens.Delete(data.ScopeTwoFactor, req.ChallengeToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("challenge_token", "invalid or expired challenge token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var ok bool
+
+	if req.Code != "" {
+		ok, err = app.verifyTOTPCode(user.Id, req.Code)
+	} else {
+		ok, err = app.models.TOTP.UseRecoveryCode(user.Id, req.RecoveryCode)
+	}
+
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		err = app.recordLoginFailure(r, user.Email, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	err = app.recordLoginSuccess(user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeAuthTokens(w, r, user)
+}
+
+func (app *app) showTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	enabled, err := app.models.TOTP.IsEnabled(user.Id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, http.StatusOK, payload{"two_factor": payload{"enabled": enabled}}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) enrollTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	enabled, err := app.models.TOTP.IsEnabled(user.Id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if enabled {
+		v := validator.New()
+		v.AddError("two_factor", "is already enabled, disable it first to enroll a new device")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TOTP.Enroll(user.Id, secret)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	enrollment := payload{
+		"secret":           totp.EncodeSecret(secret),
+		"provisioning_uri": totp.ProvisioningURI(totpIssuer, user.Email, secret),
+	}
+
+	err = app.writeJson(w, http.StatusCreated, payload{"two_factor": enrollment}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) confirmTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var req struct {
+		Code string `json:"code"`
+	}
+
+	err := app.decodeJson(r, &req)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(req.Code != "", "code", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	t, err := app.models.TOTP.GetForUser(user.Id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("two_factor", "enrollment must be started with POST /v1/users/me/2fa first")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if t.Enabled {
+		v.AddError("two_factor", "is already enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ok, err := app.verifyTOTPCode(user.Id, req.Code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		v.AddError("code", "is invalid or expired")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	codes, err := app.models.TOTP.Enable(user.Id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, http.StatusOK, payload{"two_factor": payload{"enabled": true, "recovery_codes": codes}}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) deleteTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.models.Users.Get(app.contextGetUser(r).Id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var req struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	err = app.decodeJson(r, &req)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	// Users without a password confirm with a code from their app instead
+	if !user.Password.IsSet() {
+		ok, err := app.verifyTOTPCode(user.Id, req.Code)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !ok {
+			v.AddError("code", "invalid or already used code")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	} else {
+		ok, err := user.Password.Matches(req.Password)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !ok {
+			v.AddError("password", "does not match your current password")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	err = app.models.TOTP.Delete(user.Id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJson(w, http.StatusOK, payload{"two_factor": payload{"enabled": false}}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strings"
 	"time"
 
 	"goplex.kibonga/internal/data"
@@ -11,9 +12,10 @@ import (
 
 func (app *app) registerUserHandler(w http.ResponseWriter, r *http.Request) {
 	var userReq struct {
-		Name     string `json:"name"`
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Name           string `json:"name"`
+		Email          string `json:"email"`
+		Password       string `json:"password"`
+		InvitationCode string `json:"invitation_code"`
 	}
 
 	err := app.decodeJson(r, &userReq)
@@ -28,22 +30,43 @@ func (app *app) registerUserHandler(w http.ResponseWriter, r *http.Request) {
 		Activated: false,
 	}
 
-	err = user.Password.Set(userReq.Password)
-	if err != nil {
-		app.badRequestResponse(w, r, err)
-		return
+	// The password is optional, users who leave it out log in with magic links
+	if userReq.Password != "" {
+		err = user.Password.Set(userReq.Password)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
 	}
 
 	v := validator.New()
 	data.ValidateUser(v, &user)
+
+	if user.Password.IsSet() {
+		err = app.validateNewPassword(v, userReq.Password, user.Name, user.Email)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// Invitations are required in invite mode, but are honoured in open mode
+	// too since they can come with permissions
+	if app.config.registration.mode == registrationModeInvite || userReq.InvitationCode != "" {
+		data.ValidatePlaintextInvitationCode(v, userReq.InvitationCode)
+	}
+
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	err = app.models.Users.Insert(&user)
+	err = app.models.Users.Register(&user, app.config.defaultRole, userReq.InvitationCode)
 	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrInvalidInvitation):
+			v.AddError("invitation_code", "invalid, expired or used up invitation code")
+			app.failedValidationResponse(w, r, v.Errors)
 		case errors.Is(err, data.ErrDuplicateEmail):
 			v.AddError("email", "a user with this email address already exists")
 			app.failedValidationResponse(w, r, v.Errors)
@@ -53,12 +76,6 @@ func (app *app) registerUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = app.models.Permissions.AddForUser(user.Id, "movies:read")
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
 	token, err := app.models.Tokens.New(user.Id, time.Duration(time.Hour*24*3), data.ScopeActivation)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -83,6 +100,21 @@ func (app *app) registerUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// validateNewPassword runs the checks a newly chosen password has to pass on
+// top of data.ValidatePasswordPlaintext.
+func (app *app) validateNewPassword(v *validator.Validator, password, name, email string) error {
+	data.ValidatePasswordStrength(v, password, name, email)
+
+	breached, err := app.breachedPasswords.Contains(password)
+	if err != nil {
+		return err
+	}
+
+	v.Check(!breached, "password", "has appeared in a data breach, please choose a different one")
+
+	return nil
+}
+
 func (app *app) activateUserHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Token string `json:"token"`
@@ -139,6 +171,402 @@ func (app *app) activateUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	app.sessionUsers.forgetUser(user.Id)
+
+	err = app.writeJson(w, http.StatusOK, payload{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Password string `json:"password"`
+		Token    string `json:"token"`
+	}
+
+	err := app.decodeJson(r, &req)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidatePasswordPlaintext(v, req.Password)
+	data.ValidatePlaintextToken(v, req.Token)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByToken(data.ScopePasswordReset, req.Token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired password reset token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.validateNewPassword(v, req.Password, user.Name, user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = user.Password.Set(req.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The reset token is single use, and any session opened with the old
+	// password must not outlive the change
+	err = app.models.Tokens.DeleteTokensForUser(data.ScopePasswordReset, user.Id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Tokens.DeleteSessionsForUser(user.Id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.sessionUsers.forgetUser(user.Id)
+
+	message := "your password was successfully reset"
+
+	err = app.writeJson(w, http.StatusOK, payload{"message": message}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.models.Users.Get(app.contextGetUser(r).Id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJson(w, http.StatusOK, payload{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.models.Users.Get(app.contextGetUser(r).Id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var req struct {
+		Name            *string `json:"name"`
+		Password        *string `json:"password"`
+		CurrentPassword *string `json:"current_password"`
+		MagicLoginToken *string `json:"magic_login_token"`
+	}
+
+	err = app.decodeJson(r, &req)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if req.Name != nil {
+		user.Name = *req.Name
+	}
+
+	// Users without a password prove who they are with a fresh login link
+	// instead of an old password
+	if req.Password != nil && !user.Password.IsSet() && req.MagicLoginToken == nil {
+		v.AddError("magic_login_token", "must be provided to set a password")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if req.Password != nil && user.Password.IsSet() {
+		if req.CurrentPassword == nil {
+			v.AddError("current_password", "must be provided to change the password")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		ok, err := user.Password.Matches(*req.CurrentPassword)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !ok {
+			v.AddError("current_password", "does not match your current password")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	if req.Password != nil {
+		data.ValidatePasswordPlaintext(v, *req.Password)
+
+		err = app.validateNewPassword(v, *req.Password, user.Name, user.Email)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		// Only used up once the new password is known to be acceptable
+		if !user.Password.IsSet() && !app.consumeMagicLoginToken(w, r, user, *req.MagicLoginToken) {
+			return
+		}
+
+		err = user.Password.Set(*req.Password)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	data.ValidateUser(v, user)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if req.Password != nil {
+		err = app.models.Tokens.DeleteOtherSessionsForUser(user.Id, app.contextGetSessionID(r), app.contextGetToken(r))
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.sessionUsers.forgetUser(user.Id)
+	}
+
+	err = app.writeJson(w, http.StatusOK, payload{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// consumeMagicLoginToken uses up a login link of user, sending a validation
+// error when token isn't one.
+func (app *app) consumeMagicLoginToken(w http.ResponseWriter, r *http.Request, user *data.User, token string) bool {
+	owner, err := app.models.Users.GetByToken(data.ScopeMagicLogin, token)
+	if err == nil && owner.Id != user.Id {
+		err = data.ErrRecordNotFound
+	}
+	if err == nil {
+		err = app.models.Tokens.Delete(data.ScopeMagicLogin, token)
+	}
+
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v := validator.New()
+			v.AddError("magic_login_token", "invalid or expired login token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return false
+	}
+
+	return true
+}
+
+func (app *app) requestEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.models.Users.Get(app.contextGetUser(r).Id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var req struct {
+		Email string `json:"email"`
+	}
+
+	err = app.decodeJson(r, &req)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateEmail(v, req.Email)
+	v.Check(!strings.EqualFold(req.Email, user.Email), "email", "must be different from your current email address")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user.PendingEmail = req.Email
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Tokens.DeleteTokensForUser(data.ScopeEmailChange, user.Id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.Tokens.New(user.Id, 24*time.Hour, data.ScopeEmailChange)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		data := map[string]interface{}{
+			"emailChangeToken": token.PlainText,
+			"newEmail":         user.PendingEmail,
+		}
+
+		err := app.mailer.Send(user.PendingEmail, "token_email_change.tmpl", data)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+
+		err = app.mailer.Send(user.Email, "email_change_notice.tmpl", data)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	message := "an email will be sent to the new address containing confirmation instructions"
+
+	err = app.writeJson(w, http.StatusAccepted, payload{"message": message}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *app) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+
+	err := app.decodeJson(r, &req)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidatePlaintextToken(v, req.Token)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByToken(data.ScopeEmailChange, req.Token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Id != app.contextGetUser(r).Id || user.PendingEmail == "" {
+		v.AddError("token", "invalid or expired email change token")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user.Email = user.PendingEmail
+	user.PendingEmail = ""
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Tokens.DeleteTokensForUser(data.ScopeEmailChange, user.Id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
 	err = app.writeJson(w, http.StatusOK, payload{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -0,0 +1,100 @@
+// Package breached looks passwords up in a local corpus of breached
+// passwords, so no password or hash prefix ever has to leave the machine.
+//
+// The corpus file is the raw SHA-1 digests of the breached passwords, 20
+// bytes each, sorted in ascending order with no separators. The ordered-by-hash
+// Pwned Passwords list can be turned into one by hex-decoding the hash of
+// every line and dropping the counts.
+package breached
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"sort"
+)
+
+const recordSize = sha1.Size
+
+type Corpus struct {
+	file    *os.File
+	records int64
+}
+
+// Open opens the corpus at path. It is searched in place, so even large
+// corpora don't need to fit in memory.
+func Open(path string) (*Corpus, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if info.Size()%recordSize != 0 {
+		file.Close()
+		return nil, fmt.Errorf("breached: %s is not a list of %d byte SHA-1 digests", path, recordSize)
+	}
+
+	return &Corpus{file: file, records: info.Size() / recordSize}, nil
+}
+
+func (c *Corpus) Len() int64 {
+	if c == nil {
+		return 0
+	}
+	return c.records
+}
+
+// Contains reports whether password is in the corpus. A nil Corpus contains
+// nothing.
+func (c *Corpus) Contains(password string) (bool, error) {
+	if c == nil || c.records == 0 {
+		return false, nil
+	}
+
+	digest := sha1.Sum([]byte(password))
+	record := make([]byte, recordSize)
+
+	var readErr error
+
+	i := sort.Search(int(c.records), func(i int) bool {
+		if readErr != nil {
+			return true
+		}
+
+		_, readErr = c.file.ReadAt(record, int64(i)*recordSize)
+		if readErr != nil {
+			return true
+		}
+
+		return bytes.Compare(record, digest[:]) >= 0
+	})
+
+	if readErr != nil {
+		return false, readErr
+	}
+
+	if int64(i) >= c.records {
+		return false, nil
+	}
+
+	_, err := c.file.ReadAt(record, int64(i)*recordSize)
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(record, digest[:]), nil
+}
+
+func (c *Corpus) Close() error {
+	if c == nil {
+		return nil
+	}
+	return c.file.Close()
+}
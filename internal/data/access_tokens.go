@@ -0,0 +1,63 @@
+package data
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"goplex.kibonga/internal/jwt"
+)
+
+var ErrInvalidAccessToken = errors.New("invalid access token")
+
+// AccessToken is a short-lived signed token issued along with a refresh token.
+// It names its user and the refresh token, the session, it belongs to, so it
+// stops working once that session is revoked.
+type AccessToken struct {
+	PlainText string    `json:"token"`
+	Expiry    time.Time `json:"expiry"`
+}
+
+type accessTokenClaims struct {
+	jwt.Claims
+	Session int64 `json:"sid"`
+}
+
+func NewAccessToken(u *User, sessionID int64, ttl time.Duration, key []byte) (*AccessToken, error) {
+	now := time.Now()
+	expiry := now.Add(ttl)
+
+	claims := &accessTokenClaims{
+		Claims: jwt.Claims{
+			Subject:   strconv.FormatInt(u.Id, 10),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: expiry.Unix(),
+		},
+		Session: sessionID,
+	}
+
+	plaintext, err := jwt.Sign(claims, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AccessToken{PlainText: plaintext, Expiry: time.Unix(claims.ExpiresAt, 0)}, nil
+}
+
+// VerifyAccessToken verifies an access token and returns the ids of the user
+// and of the session it was issued for.
+func VerifyAccessToken(plaintext string, key []byte) (userID, sessionID int64, err error) {
+	var claims accessTokenClaims
+
+	err = jwt.Verify(plaintext, key, &claims)
+	if err != nil {
+		return 0, 0, ErrInvalidAccessToken
+	}
+
+	userID, err = strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || userID < 1 || claims.Session < 1 {
+		return 0, 0, ErrInvalidAccessToken
+	}
+
+	return userID, claims.Session, nil
+}
@@ -0,0 +1,185 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"goplex.kibonga/internal/validator"
+)
+
+// APIKeyPrefix marks plaintext API keys so they can't be mistaken for
+// authentication tokens, e.g. when scanning logs for leaked secrets.
+const APIKeyPrefix = "gpx_"
+
+type APIKey struct {
+	Id          int64       `json:"id"`
+	UserID      int64       `json:"-"`
+	Name        string      `json:"name"`
+	PlainText   string      `json:"key,omitempty"`
+	Hash        []byte      `json:"-"`
+	Permissions Permissions `json:"permissions"`
+	Expiry      *time.Time  `json:"expiry"`
+	CreatedAt   time.Time   `json:"created_at"`
+}
+
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+func generateAPIKey(userID int64, name string, permissions Permissions, expiry *time.Time) (*APIKey, error) {
+	key := &APIKey{
+		UserID:      userID,
+		Name:        name,
+		Permissions: permissions,
+		Expiry:      expiry,
+	}
+
+	randBytes := make([]byte, 32)
+
+	_, err := rand.Read(randBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key.PlainText = APIKeyPrefix + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randBytes))
+	key.Hash = hashToken(key.PlainText)
+
+	return key, nil
+}
+
+func ValidateAPIKey(v *validator.Validator, k *APIKey) {
+	v.Check(v.RequiredString(k.Name), "name", "must be provided")
+	v.Check(len(k.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(len(k.Permissions) > 0, "permissions", "must contain at least one permission")
+	v.Check(validator.Unique(k.Permissions...), "permissions", "must not contain duplicates")
+
+	if k.Expiry != nil {
+		v.Check(k.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+func ValidatePlaintextAPIKey(v *validator.Validator, key string) {
+	v.Check(key != "", "key", "must be provided")
+	v.Check(strings.HasPrefix(key, APIKeyPrefix), "key", "must start with "+APIKeyPrefix)
+	v.Check(len(key) == len(APIKeyPrefix)+52, "key", "must be 56 bytes long")
+}
+
+func (m APIKeyModel) New(userID int64, name string, permissions Permissions, expiry *time.Time) (*APIKey, error) {
+	key, err := generateAPIKey(userID, name, permissions, expiry)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `insert into api_keys (user_id, name, hash, permissions, expiry)
+	values ($1, $2, $3, $4, $5)
+	returning id, created_at`
+
+	args := []interface{}{key.UserID, key.Name, key.Hash, pq.Array(key.Permissions), key.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&key.Id, &key.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// GetByPlaintext looks up an API key that hasn't expired yet.
+func (m APIKeyModel) GetByPlaintext(plaintext string) (*APIKey, error) {
+	query := `select id, user_id, name, hash, permissions, expiry, created_at
+	from api_keys
+	where hash = $1 and (expiry is null or expiry > $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	var key APIKey
+
+	err := m.DB.QueryRowContext(ctx, query, hashToken(plaintext), time.Now()).Scan(
+		&key.Id,
+		&key.UserID,
+		&key.Name,
+		&key.Hash,
+		pq.Array(&key.Permissions),
+		&key.Expiry,
+		&key.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &key, nil
+}
+
+func (m APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	query := `select id, user_id, name, hash, permissions, expiry, created_at
+	from api_keys
+	where user_id = $1
+	order by id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	sqlRows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer sqlRows.Close()
+
+	keys := []*APIKey{}
+
+	for sqlRows.Next() {
+		var key APIKey
+
+		err = sqlRows.Scan(&key.Id, &key.UserID, &key.Name, &key.Hash, pq.Array(&key.Permissions), &key.Expiry, &key.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &key)
+	}
+
+	if err = sqlRows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (m APIKeyModel) DeleteForUser(id, userID int64) error {
+	query := `delete from api_keys
+	where id = $1 and user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	sqlRes, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := sqlRes.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// AuditEntry records a request made by an admin impersonating a user.
+type AuditEntry struct {
+	Id             int64     `json:"id"`
+	UserID         int64     `json:"user_id"`
+	ImpersonatorID int64     `json:"impersonator_id"`
+	Method         string    `json:"method"`
+	Path           string    `json:"path"`
+	Status         int       `json:"status"`
+	IP             string    `json:"ip"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type AuditLogModel struct {
+	DB *sql.DB
+}
+
+func (m AuditLogModel) Insert(e *AuditEntry) error {
+	query := `insert into audit_log (user_id, impersonator_id, method, path, status, ip)
+	values ($1, $2, $3, $4, $5, $6)
+	returning id, created_at`
+
+	args := []interface{}{e.UserID, e.ImpersonatorID, e.Method, e.Path, e.Status, e.IP}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&e.Id, &e.CreatedAt)
+}
+
+// GetAll lists audit entries, optionally only those about userID or made by
+// impersonatorID. Zero ids match everything.
+func (m AuditLogModel) GetAll(userID, impersonatorID int64, filters *Filters) ([]*AuditEntry, Metadata, error) {
+	query := fmt.Sprintf(`select count(*) over(), id, coalesce(user_id, 0), coalesce(impersonator_id, 0), method, path, status, ip, created_at
+	from audit_log
+	where (user_id = $1 or $1 = 0) and (impersonator_id = $2 or $2 = 0)
+	order by %s %s, id desc limit $3 offset $4`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{userID, impersonatorID, filters.limit(), filters.offset()}
+
+	sqlRows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer sqlRows.Close()
+
+	totalRecords := 0
+	entries := []*AuditEntry{}
+
+	for sqlRows.Next() {
+		var e AuditEntry
+
+		err = sqlRows.Scan(&totalRecords, &e.Id, &e.UserID, &e.ImpersonatorID, &e.Method, &e.Path, &e.Status, &e.IP, &e.CreatedAt)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		entries = append(entries, &e)
+	}
+
+	if err := sqlRows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return entries, metadata, nil
+}
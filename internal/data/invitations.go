@@ -0,0 +1,171 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"goplex.kibonga/internal/validator"
+)
+
+var ErrInvalidInvitation = errors.New("invalid invitation")
+
+// Invitation lets people register while registration is invite only. It can
+// be bound to a single email, and grants its permissions instead of the
+// default role.
+type Invitation struct {
+	Id          int64       `json:"id"`
+	PlainText   string      `json:"code,omitempty"`
+	Hash        []byte      `json:"-"`
+	Email       string      `json:"email,omitempty"`
+	Permissions Permissions `json:"permissions"`
+	MaxUses     int         `json:"max_uses"`
+	Uses        int         `json:"uses"`
+	Expiry      time.Time   `json:"expiry"`
+	CreatedBy   int64       `json:"created_by,omitempty"`
+	CreatedAt   time.Time   `json:"created_at"`
+}
+
+type InvitationModel struct {
+	DB *sql.DB
+}
+
+func ValidateInvitation(v *validator.Validator, i *Invitation) {
+	if i.Email != "" {
+		v.Check(validEmail(i.Email), "email", "must be a valid email address")
+	}
+
+	v.Check(validator.Unique(i.Permissions...), "permissions", "must not contain duplicates")
+	v.Check(i.MaxUses >= 1, "max_uses", "must be at least 1")
+	v.Check(i.MaxUses <= 1000, "max_uses", "must not be more than 1000")
+	v.Check(i.Expiry.After(time.Now()), "expiry", "must be in the future")
+}
+
+func ValidatePlaintextInvitationCode(v *validator.Validator, code string) {
+	v.Check(code != "", "invitation_code", "must be provided")
+	v.Check(len(code) == 26, "invitation_code", "must be 26 bytes long")
+}
+
+func (m InvitationModel) New(i *Invitation) error {
+	randBytes := make([]byte, 16)
+
+	_, err := rand.Read(randBytes)
+	if err != nil {
+		return err
+	}
+
+	i.PlainText = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randBytes)
+	i.Hash = hashToken(i.PlainText)
+
+	if i.Permissions == nil {
+		i.Permissions = Permissions{}
+	}
+
+	query := `insert into invitations (hash, email, permissions, max_uses, expiry, created_by)
+	values ($1, nullif($2, ''), $3, $4, $5, $6)
+	returning id, created_at`
+
+	args := []interface{}{i.Hash, i.Email, pq.Array(i.Permissions), i.MaxUses, i.Expiry, i.CreatedBy}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&i.Id, &i.CreatedAt)
+}
+
+func (m InvitationModel) GetAll() ([]*Invitation, error) {
+	query := `select id, hash, coalesce(email, ''), permissions, max_uses, uses, expiry, coalesce(created_by, 0), created_at
+	from invitations
+	order by id desc`
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	sqlRows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer sqlRows.Close()
+
+	invitations := []*Invitation{}
+
+	for sqlRows.Next() {
+		var i Invitation
+
+		err = sqlRows.Scan(&i.Id, &i.Hash, &i.Email, pq.Array(&i.Permissions), &i.MaxUses, &i.Uses, &i.Expiry, &i.CreatedBy, &i.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		invitations = append(invitations, &i)
+	}
+
+	if err = sqlRows.Err(); err != nil {
+		return nil, err
+	}
+
+	return invitations, nil
+}
+
+// consumeInvitation uses up one use of the invitation with the given code, as
+// long as it hasn't expired, has uses left and isn't bound to another email.
+// It is a single statement so concurrent registrations can't overuse an
+// invitation.
+func consumeInvitation(ctx context.Context, tx *sql.Tx, plaintext, email string) (*Invitation, error) {
+	query := `update invitations
+	set uses = uses + 1
+	where hash = $1 and uses < max_uses and expiry > $2 and (email is null or email = $3)
+	returning id, hash, coalesce(email, ''), permissions, max_uses, uses, expiry, coalesce(created_by, 0), created_at`
+
+	var i Invitation
+
+	err := tx.QueryRowContext(ctx, query, hashToken(plaintext), time.Now(), email).Scan(
+		&i.Id,
+		&i.Hash,
+		&i.Email,
+		pq.Array(&i.Permissions),
+		&i.MaxUses,
+		&i.Uses,
+		&i.Expiry,
+		&i.CreatedBy,
+		&i.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrInvalidInvitation
+		default:
+			return nil, err
+		}
+	}
+
+	return &i, nil
+}
+
+func (m InvitationModel) Delete(id int64) error {
+	query := `delete from invitations
+	where id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	sqlRes, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := sqlRes.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// LoginAttempt tracks consecutive failed logins for an email address. It is
+// keyed by email rather than user so unknown addresses are throttled exactly
+// like registered ones.
+type LoginAttempt struct {
+	Email        string
+	FailedCount  int
+	LastFailedAt time.Time
+	LockedUntil  *time.Time
+}
+
+type LoginAttemptModel struct {
+	DB *sql.DB
+}
+
+func (a *LoginAttempt) Locked() bool {
+	return a.LockedUntil != nil && a.LockedUntil.After(time.Now())
+}
+
+// Get returns the failed logins for email, an email without failures gets a
+// zero LoginAttempt.
+func (m LoginAttemptModel) Get(email string) (*LoginAttempt, error) {
+	query := `select email, failed_count, last_failed_at, locked_until
+	from login_attempts
+	where email = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var a LoginAttempt
+
+	err := m.DB.QueryRowContext(ctx, query, email).Scan(&a.Email, &a.FailedCount, &a.LastFailedAt, &a.LockedUntil)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return &LoginAttempt{Email: email}, nil
+		default:
+			return nil, err
+		}
+	}
+
+	return &a, nil
+}
+
+// RecordFailure counts a failed login for email. Reaching lockAfter failures
+// locks the email for lockFor and starts the count over, the returned bool
+// reports whether this failure is the one that locked it.
+func (m LoginAttemptModel) RecordFailure(email string, lockAfter int, lockFor time.Duration) (*LoginAttempt, bool, error) {
+	query := `insert into login_attempts (email, failed_count, last_failed_at)
+	values ($1, 1, now())
+	on conflict (email) do update
+	set failed_count = case when login_attempts.failed_count + 1 >= $2 then 0 else login_attempts.failed_count + 1 end,
+		locked_until = case when login_attempts.failed_count + 1 >= $2 then $3 else login_attempts.locked_until end,
+		last_failed_at = now()
+	returning email, failed_count, last_failed_at, locked_until`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{email, lockAfter, time.Now().Add(lockFor)}
+
+	var a LoginAttempt
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&a.Email, &a.FailedCount, &a.LastFailedAt, &a.LockedUntil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &a, a.FailedCount == 0 && a.Locked(), nil
+}
+
+func (m LoginAttemptModel) Reset(email string) error {
+	query := `delete from login_attempts
+	where email = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, email)
+	return err
+}
+
+// DeleteStale forgets the failed logins of emails that last failed before
+// failedBefore and aren't locked anymore.
+func (m LoginAttemptModel) DeleteStale(failedBefore time.Time) (int64, error) {
+	query := `delete from login_attempts
+	where last_failed_at < $1 and (locked_until is null or locked_until < now())`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	sqlRes, err := m.DB.ExecContext(ctx, query, failedBefore)
+	if err != nil {
+		return 0, err
+	}
+
+	return sqlRes.RowsAffected()
+}
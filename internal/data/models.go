@@ -3,13 +3,21 @@ package data
 import (
 	"database/sql"
 	"errors"
+	"time"
 )
 
 type Models struct {
-	Movies      MovieModel
-	Users       UserModel
-	Tokens      TokenModel
-	Permissions PermissionModel
+	Movies         MovieModel
+	MovieRevisions MovieRevisionModel
+	Users          UserModel
+	Tokens         TokenModel
+	Permissions    PermissionModel
+	Roles          RoleModel
+	APIKeys        APIKeyModel
+	TOTP           TOTPModel
+	LoginAttempts  LoginAttemptModel
+	Invitations    InvitationModel
+	AuditLog       AuditLogModel
 }
 
 var (
@@ -17,11 +25,22 @@ var (
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
-func NewModels(db *sql.DB) Models {
+// NewModels wires up the models around db. Effective permissions are cached
+// in memory for permissionsCacheTTL, a zero TTL disables the cache.
+func NewModels(db *sql.DB, permissionsCacheTTL time.Duration) Models {
+	permissionCache := newPermissionCache(permissionsCacheTTL)
+
 	return Models{
-		Movies:      MovieModel{DB: db},
-		Users:       UserModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Permissions: PermissionModel{DB: db},
+		Movies:         MovieModel{DB: db},
+		MovieRevisions: MovieRevisionModel{DB: db},
+		Users:          UserModel{DB: db},
+		Tokens:         TokenModel{DB: db},
+		Permissions:    PermissionModel{DB: db, cache: permissionCache},
+		Roles:          RoleModel{DB: db},
+		APIKeys:        APIKeyModel{DB: db},
+		TOTP:           TOTPModel{DB: db},
+		LoginAttempts:  LoginAttemptModel{DB: db},
+		Invitations:    InvitationModel{DB: db},
+		AuditLog:       AuditLogModel{DB: db},
 	}
 }
@@ -0,0 +1,191 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+const (
+	RevisionInsert   = "insert"
+	RevisionUpdate   = "update"
+	RevisionDelete   = "delete"
+	RevisionRollback = "rollback"
+	RevisionRestore  = "restore"
+)
+
+// MovieSnapshot is the state of a movie as of one revision.
+type MovieSnapshot struct {
+	Title   string   `json:"title"`
+	Year    int32    `json:"year"`
+	Runtime Runtime  `json:"runtime"`
+	Genres  []string `json:"genres"`
+}
+
+// FieldChange is what a revision did to one field of a movie.
+type FieldChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// MovieRevision records a change to a movie. Version is the version of the
+// movie the change led to, and deletions get a version of their own.
+type MovieRevision struct {
+	Id        int64                  `json:"id"`
+	MovieID   int64                  `json:"movie_id"`
+	Version   int32                  `json:"version"`
+	Action    string                 `json:"action"`
+	UserID    int64                  `json:"user_id"`
+	Snapshot  MovieSnapshot          `json:"snapshot"`
+	Diff      map[string]FieldChange `json:"diff"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+type MovieRevisionModel struct {
+	DB *sql.DB
+}
+
+func snapshotOf(movie *Movie) *MovieSnapshot {
+	return &MovieSnapshot{
+		Title:   movie.Title,
+		Year:    movie.Year,
+		Runtime: movie.Runtime,
+		Genres:  movie.Genres,
+	}
+}
+
+// snapshotFields are the fields diffs are made of.
+var snapshotFields = []string{"title", "year", "runtime", "genres"}
+
+// diffSnapshots lists the fields that differ between from and to, either of
+// which may be nil for a movie that doesn't exist.
+func diffSnapshots(from, to *MovieSnapshot) map[string]FieldChange {
+	fromFields, toFields := from.fields(), to.fields()
+
+	diff := make(map[string]FieldChange)
+
+	for _, name := range snapshotFields {
+		f, t := fromFields[name], toFields[name]
+
+		if !reflect.DeepEqual(f, t) {
+			diff[name] = FieldChange{From: f, To: t}
+		}
+	}
+
+	return diff
+}
+
+func (s *MovieSnapshot) fields() map[string]interface{} {
+	if s == nil {
+		return map[string]interface{}{}
+	}
+
+	return map[string]interface{}{
+		"title":   s.Title,
+		"year":    s.Year,
+		"runtime": s.Runtime,
+		"genres":  s.Genres,
+	}
+}
+
+// insertMovieRevision records a revision as part of the transaction that
+// made the change.
+func insertMovieRevision(ctx context.Context, tx *sql.Tx, movieID int64, version int32, action string, userID int64, snapshot *MovieSnapshot, diff map[string]FieldChange) error {
+	snapshotJSON, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	diffJSON, err := json.Marshal(diff)
+	if err != nil {
+		return err
+	}
+
+	query := `insert into movie_revisions (movie_id, version, action, user_id, snapshot, diff)
+	values ($1, $2, $3, nullif($4::bigint, 0), $5, $6)`
+
+	_, err = tx.ExecContext(ctx, query, movieID, version, action, userID, snapshotJSON, diffJSON)
+	return err
+}
+
+func scanMovieRevision(scan func(...interface{}) error, rev *MovieRevision, extra ...interface{}) error {
+	var snapshot, diff []byte
+
+	dest := append(extra, &rev.Id, &rev.MovieID, &rev.Version, &rev.Action, &rev.UserID, &snapshot, &diff, &rev.CreatedAt)
+
+	err := scan(dest...)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(snapshot, &rev.Snapshot)
+	if err != nil {
+		return fmt.Errorf("decoding movie revision snapshot: %w", err)
+	}
+
+	return json.Unmarshal(diff, &rev.Diff)
+}
+
+func (m MovieRevisionModel) Get(movieID int64, version int32) (*MovieRevision, error) {
+	query := `select id, movie_id, version, action, coalesce(user_id, 0), snapshot, diff, created_at
+	from movie_revisions
+	where movie_id = $1 and version = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	var rev MovieRevision
+
+	err := scanMovieRevision(m.DB.QueryRowContext(ctx, query, movieID, version).Scan, &rev)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &rev, nil
+}
+
+func (m MovieRevisionModel) GetAllForMovie(movieID int64, filters *Filters) ([]*MovieRevision, Metadata, error) {
+	query := fmt.Sprintf(`select count(*) over(), id, movie_id, version, action, coalesce(user_id, 0), snapshot, diff, created_at
+	from movie_revisions
+	where movie_id = $1
+	order by %s %s, id asc limit $2 offset $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	sqlRows, err := m.DB.QueryContext(ctx, query, movieID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer sqlRows.Close()
+
+	totalRecords := 0
+	revisions := []*MovieRevision{}
+
+	for sqlRows.Next() {
+		var rev MovieRevision
+
+		err = scanMovieRevision(sqlRows.Scan, &rev, &totalRecords)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		revisions = append(revisions, &rev)
+	}
+
+	if err := sqlRows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return revisions, metadata, nil
+}
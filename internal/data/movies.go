@@ -12,13 +12,15 @@ import (
 )
 
 type Movie struct {
-	Id        int64     `json:"id"`
-	CreatedAt time.Time `json:"-"`
-	Title     string    `json:"title"`
-	Year      int32     `json:"released,omitempty"`
-	Runtime   Runtime   `json:"runtime,omitempty"`
-	Genres    []string  `json:"genres,omitempty"`
-	Version   int32     `json:"version,omitempty"`
+	Id        int64      `json:"id"`
+	CreatedAt time.Time  `json:"-"`
+	UpdatedAt time.Time  `json:"-"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	Title     string     `json:"title"`
+	Year      int32      `json:"released,omitempty"`
+	Runtime   Runtime    `json:"runtime,omitempty"`
+	Genres    []string   `json:"genres,omitempty"`
+	Version   int32      `json:"version,omitempty"`
 }
 
 type MovieModel struct {
@@ -94,41 +96,120 @@ func uniqueGenres(genres []string) bool {
 	return validator.Unique(genres...)
 }
 
-func (m MovieModel) Insert(movie *Movie) error {
+// Insert adds the movie and records its first revision as made by userID.
+func (m MovieModel) Insert(movie *Movie, userID int64) error {
 	query := `insert into movies (title, year, runtime, genres)
 	values ($1, $2, $3, $4)
-	returning id, created_at, version`
+	returning id, created_at, updated_at, version`
 
 	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
 	defer cancel()
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Id, &movie.CreatedAt, &movie.Version)
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&movie.Id, &movie.CreatedAt, &movie.UpdatedAt, &movie.Version)
+	if err != nil {
+		return err
+	}
+
+	snapshot := snapshotOf(movie)
+
+	err = insertMovieRevision(ctx, tx, movie.Id, movie.Version, RevisionInsert, userID, snapshot, diffSnapshots(nil, snapshot))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (m MovieModel) Update(movie *Movie) error {
+// Update saves the movie as long as it is still at movie.Version, otherwise
+// it returns ErrEditConflict, or ErrRecordNotFound when the movie is gone. The
+// change is recorded as a revision by userID.
+func (m MovieModel) Update(movie *Movie, userID int64) error {
+	return m.update(movie, userID, RevisionUpdate)
+}
+
+// RollBack sets the movie back to the state of rev, through the same version
+// check as Update.
+func (m MovieModel) RollBack(movie *Movie, rev *MovieRevision, userID int64) error {
+	movie.Title = rev.Snapshot.Title
+	movie.Year = rev.Snapshot.Year
+	movie.Runtime = rev.Snapshot.Runtime
+	movie.Genres = rev.Snapshot.Genres
+
+	return m.update(movie, userID, RevisionRollback)
+}
+
+func (m MovieModel) update(movie *Movie, userID int64, action string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	previous, err := lockMovie(ctx, tx, movie.Id, movie.Version)
+	if err != nil {
+		return err
+	}
+
 	query := `update movies
-	set title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
+	set title = $1, year = $2, runtime = $3, genres = $4, version = version + 1, updated_at = now()
 	where id = $5 and version = $6
-	returning version`
+	returning version, updated_at`
 
 	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.Id, movie.Version}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
-	defer cancel()
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&movie.Version, &movie.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	snapshot := snapshotOf(movie)
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
+	err = insertMovieRevision(ctx, tx, movie.Id, movie.Version, action, userID, snapshot, diffSnapshots(previous, snapshot))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// lockMovie reads the movie at version and locks its row for the rest of tx.
+// It returns ErrRecordNotFound when the movie is gone or in the trash, and
+// ErrEditConflict when it isn't at version anymore.
+func lockMovie(ctx context.Context, tx *sql.Tx, id int64, version int32) (*MovieSnapshot, error) {
+	query := `select title, year, runtime, genres, version
+	from movies
+	where id = $1 and deleted_at is null
+	for update`
+
+	var s MovieSnapshot
+	var current int32
+
+	err := tx.QueryRowContext(ctx, query, id).Scan(&s.Title, &s.Year, &s.Runtime, pq.Array(&s.Genres), &current)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
-			return ErrEditConflict
+			return nil, ErrRecordNotFound
 		default:
-			return err
+			return nil, err
 		}
 	}
 
-	return nil
+	if current != version {
+		return nil, ErrEditConflict
+	}
+
+	return &s, nil
 }
 
 func (m MovieModel) Get(id int) (*Movie, error) {
@@ -136,8 +217,8 @@ func (m MovieModel) Get(id int) (*Movie, error) {
 		return nil, ErrRecordNotFound
 	}
 
-	query := `select id, created_at, title, year, runtime, genres, version
-	from movies where id = $1`
+	query := `select id, created_at, updated_at, title, year, runtime, genres, version
+	from movies where id = $1 and deleted_at is null`
 
 	movie := Movie{}
 
@@ -147,6 +228,7 @@ func (m MovieModel) Get(id int) (*Movie, error) {
 	err := m.DB.QueryRowContext(ctx, query, id).Scan(
 		&movie.Id,
 		&movie.CreatedAt,
+		&movie.UpdatedAt,
 		&movie.Title,
 		&movie.Year,
 		&movie.Runtime,
@@ -165,35 +247,47 @@ func (m MovieModel) Get(id int) (*Movie, error) {
 	return &movie, nil
 }
 
-func (m MovieModel) Delete(id int) error {
-	query := `delete from movies
-	where id = $1`
-
+// Delete moves the movie to the trash as long as it is still at version,
+// otherwise it returns ErrEditConflict, or ErrRecordNotFound when the movie is
+// gone already. Trashed movies are left out by Get and GetAll until they are
+// restored or purged. The deletion is recorded as a revision by userID.
+func (m MovieModel) Delete(id int64, version int32, userID int64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
 	defer cancel()
 
-	sqlRes, err := m.DB.ExecContext(ctx, query, id)
+	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	rowsAffected, err := sqlRes.RowsAffected()
+	previous, err := lockMovie(ctx, tx, id, version)
 	if err != nil {
 		return err
 	}
 
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
+	query := `update movies
+	set deleted_at = now(), version = version + 1
+	where id = $1`
+
+	_, err = tx.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	err = insertMovieRevision(ctx, tx, id, version+1, RevisionDelete, userID, previous, diffSnapshots(previous, nil))
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
 
 func (m MovieModel) GetAll(title string, genres []string, filters *Filters) ([]*Movie, Metadata, error) {
-	query := fmt.Sprintf(`select count(*) over(), id, created_at, title, year, runtime, genres, version
+	query := fmt.Sprintf(`select count(*) over(), id, created_at, updated_at, title, year, runtime, genres, version
 	from movies 
 	where (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) or $1 = '') and
-	(genres @> $2 or $2 = '{}')
+	(genres @> $2 or $2 = '{}') and deleted_at is null
 	order by %s %s, id asc limit $3 offset $4`, filters.sortColumn(), filters.sortDirection())
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
@@ -213,7 +307,96 @@ func (m MovieModel) GetAll(title string, genres []string, filters *Filters) ([]*
 	for sqlRows.Next() {
 		var m Movie
 
-		err = sqlRows.Scan(&totalRecords, &m.Id, &m.CreatedAt, &m.Title, &m.Year, &m.Runtime, pq.Array(&m.Genres), &m.Version)
+		err = sqlRows.Scan(&totalRecords, &m.Id, &m.CreatedAt, &m.UpdatedAt, &m.Title, &m.Year, &m.Runtime, pq.Array(&m.Genres), &m.Version)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		movies = append(movies, &m)
+	}
+
+	if err := sqlRows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return movies, metadata, nil
+}
+
+// Restore takes the movie out of the trash, recording it as a revision by
+// userID. It returns ErrRecordNotFound when the movie isn't in the trash.
+func (m MovieModel) Restore(id int64, userID int64) (*Movie, error) {
+	query := `update movies
+	set deleted_at = null, version = version + 1, updated_at = now()
+	where id = $1 and deleted_at is not null
+	returning id, created_at, updated_at, title, year, runtime, genres, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var movie Movie
+
+	err = tx.QueryRowContext(ctx, query, id).Scan(
+		&movie.Id,
+		&movie.CreatedAt,
+		&movie.UpdatedAt,
+		&movie.Title,
+		&movie.Year,
+		&movie.Runtime,
+		pq.Array(&movie.Genres),
+		&movie.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	// Restoring doesn't change any of the fields, so the diff is empty
+	err = insertMovieRevision(ctx, tx, movie.Id, movie.Version, RevisionRestore, userID, snapshotOf(&movie), map[string]FieldChange{})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &movie, nil
+}
+
+// GetAllTrashed lists the movies in the trash.
+func (m MovieModel) GetAllTrashed(filters *Filters) ([]*Movie, Metadata, error) {
+	query := fmt.Sprintf(`select count(*) over(), id, created_at, updated_at, deleted_at, title, year, runtime, genres, version
+	from movies
+	where deleted_at is not null
+	order by %s %s, id asc limit $1 offset $2`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	sqlRows, err := m.DB.QueryContext(ctx, query, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer sqlRows.Close()
+
+	totalRecords := 0
+	movies := []*Movie{}
+
+	for sqlRows.Next() {
+		var m Movie
+
+		err = sqlRows.Scan(&totalRecords, &m.Id, &m.CreatedAt, &m.UpdatedAt, &m.DeletedAt, &m.Title, &m.Year, &m.Runtime, pq.Array(&m.Genres), &m.Version)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
@@ -228,3 +411,20 @@ func (m MovieModel) GetAll(title string, genres []string, filters *Filters) ([]*
 	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
 	return movies, metadata, nil
 }
+
+// Purge permanently removes the movies that were moved to the trash before
+// deletedBefore, and returns how many there were. Their revisions are kept.
+func (m MovieModel) Purge(deletedBefore time.Time) (int64, error) {
+	query := `delete from movies
+	where deleted_at < $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	sqlRes, err := m.DB.ExecContext(ctx, query, deletedBefore)
+	if err != nil {
+		return 0, err
+	}
+
+	return sqlRes.RowsAffected()
+}
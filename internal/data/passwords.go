@@ -0,0 +1,203 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrInvalidPasswordHash = errors.New("invalid password hash")
+
+// Argon2Params are the argon2id parameters new password hashes are made with.
+// Memory is in KiB.
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// PasswordHashing holds the parameters for new hashes, it is meant to be set
+// once at startup. Hashes made with other parameters keep working, and are
+// reported by NeedsRehash.
+var PasswordHashing = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+const argon2idPrefix = "$argon2id$"
+
+var b64 = base64.RawStdEncoding
+
+// dummyPasswordHash is what logins for unknown emails are checked against, so
+// they cost the same work as logins for real users.
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, err := hashArgon2id("not a real password", PasswordHashing)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+})
+
+type password struct {
+	plaintext *string
+	hash      []byte
+}
+
+// Set hashes plaintextPassword with argon2id, the hash is stored in the PHC
+// string format so it carries its own algorithm and parameters.
+func (p *password) Set(plaintextPassword string) error {
+	hash, err := hashArgon2id(plaintextPassword, PasswordHashing)
+	if err != nil {
+		return err
+	}
+
+	p.hash = hash
+	p.plaintext = &plaintextPassword
+
+	return nil
+}
+
+// IsSet reports whether the user has a password at all. Users who only log in
+// with magic links don't.
+func (p *password) IsSet() bool {
+	return p.hash != nil
+}
+
+// value is the hash as stored in the database, NULL for users without a
+// password.
+func (p *password) value() interface{} {
+	if p.hash == nil {
+		return nil
+	}
+	return p.hash
+}
+
+// Matches checks plaintextPassword against the hash, which may be an argon2id
+// PHC string or a legacy bcrypt hash. Nothing matches a user without a
+// password.
+func (p *password) Matches(plaintextPassword string) (bool, error) {
+	if p.hash == nil {
+		MatchesNoPassword(plaintextPassword)
+		return false, nil
+	}
+
+	if strings.HasPrefix(string(p.hash), argon2idPrefix) {
+		return matchesArgon2id(p.hash, plaintextPassword)
+	}
+
+	// bcrypt silently ignores everything past 72 bytes
+	if len(plaintextPassword) > 72 {
+		return false, nil
+	}
+
+	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
+	if err != nil {
+		switch {
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// NeedsRehash reports whether the hash was made with another algorithm or
+// other parameters than the current ones.
+func (p *password) NeedsRehash() bool {
+	if p.hash == nil {
+		return false
+	}
+
+	params, _, _, err := decodeArgon2id(p.hash)
+	if err != nil {
+		return true
+	}
+
+	return params.Memory != PasswordHashing.Memory ||
+		params.Iterations != PasswordHashing.Iterations ||
+		params.Parallelism != PasswordHashing.Parallelism ||
+		params.KeyLength != PasswordHashing.KeyLength
+}
+
+// MatchesNoPassword does the work of password.Matches without a password to
+// match, for login attempts against emails that don't belong to any user.
+func MatchesNoPassword(plaintextPassword string) {
+	matchesArgon2id(dummyPasswordHash(), plaintextPassword)
+}
+
+func hashArgon2id(plaintextPassword string, params Argon2Params) ([]byte, error) {
+	salt := make([]byte, params.SaltLength)
+
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(plaintextPassword), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+
+	hash := fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix, argon2.Version, params.Memory, params.Iterations, params.Parallelism, b64.EncodeToString(salt), b64.EncodeToString(key))
+
+	return []byte(hash), nil
+}
+
+func matchesArgon2id(hash []byte, plaintextPassword string) (bool, error) {
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+
+	otherKey := argon2.IDKey([]byte(plaintextPassword), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+
+	return subtle.ConstantTimeCompare(key, otherKey) == 1, nil
+}
+
+func decodeArgon2id(hash []byte) (*Argon2Params, []byte, []byte, error) {
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, nil, nil, ErrInvalidPasswordHash
+	}
+
+	var version int
+
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return nil, nil, nil, ErrInvalidPasswordHash
+	}
+
+	var params Argon2Params
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return nil, nil, nil, ErrInvalidPasswordHash
+	}
+
+	salt, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, ErrInvalidPasswordHash
+	}
+
+	key, err := b64.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, ErrInvalidPasswordHash
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+
+	return &params, salt, key, nil
+}
@@ -11,7 +11,8 @@ import (
 type Permissions []string
 
 type PermissionModel struct {
-	DB *sql.DB
+	DB    *sql.DB
+	cache *permissionCache
 }
 
 func (perms Permissions) Include(code string) bool {
@@ -23,11 +24,56 @@ func (perms Permissions) Include(code string) bool {
 	return false
 }
 
+// GetAll returns every permission there is.
+func (m *PermissionModel) GetAll() (Permissions, error) {
+	query := `select code from permissions order by code`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	sqlRows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var permissions Permissions
+
+	defer sqlRows.Close()
+
+	for sqlRows.Next() {
+		var permission string
+
+		err = sqlRows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+
+	if err = sqlRows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// GetAllForUser returns the effective permissions of a user, which are the
+// permissions granted to them directly plus those of every role they hold.
 func (m *PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+	permissions, generation, ok := m.cache.get(userID)
+	if ok {
+		return permissions, nil
+	}
+
 	query := `select p.code from permissions p
 	inner join users_permissions up on p.id = up.permission_id
-	inner join users u on u.id = up.user_id
-	where up.user_id = $1`
+	where up.user_id = $1
+	union
+	select p.code from permissions p
+	inner join roles_permissions rp on p.id = rp.permission_id
+	inner join users_roles ur on ur.role_id = rp.role_id
+	where ur.user_id = $1`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -37,8 +83,6 @@ func (m *PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 		return nil, err
 	}
 
-	var permissions Permissions
-
 	defer sqlRows.Close()
 
 	for sqlRows.Next() {
@@ -56,12 +100,19 @@ func (m *PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 		return nil, err
 	}
 
+	m.cache.set(userID, generation, permissions)
+
 	return permissions, nil
 }
 
+func (m *PermissionModel) CacheStats() PermissionCacheStats {
+	return m.cache.stats()
+}
+
 func (m *PermissionModel) AddForUser(userID int64, permissions ...string) error {
 	query := `insert into users_permissions(user_id, permission_id)
-	select $1, id from permissions where code = any($2)`
+	select $1, id from permissions where code = any($2)
+	on conflict do nothing`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -69,5 +120,30 @@ func (m *PermissionModel) AddForUser(userID int64, permissions ...string) error
 	args := []interface{}{userID, pq.Array(permissions)}
 
 	_, err := m.DB.ExecContext(ctx, query, args...)
-	return err
+	if err != nil {
+		return err
+	}
+
+	m.cache.invalidate(userID)
+
+	return nil
+}
+
+func (m *PermissionModel) RemoveForUser(userID int64, permissions ...string) error {
+	query := `delete from users_permissions
+	where user_id = $1 and permission_id in (select id from permissions where code = any($2))`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{userID, pq.Array(permissions)}
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	m.cache.invalidate(userID)
+
+	return nil
 }
@@ -0,0 +1,127 @@
+package data
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type PermissionCacheStats struct {
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Entries int   `json:"entries"`
+}
+
+type permissionCacheEntry struct {
+	permissions Permissions
+	expiry      time.Time
+}
+
+// permissionCache keeps the effective permissions of recently seen users in
+// memory for ttl. Models that change permissions invalidate the affected
+// entries, so ttl only bounds staleness across multiple instances.
+//
+// Every invalidation bumps the user's generation, and set drops permissions
+// that were read from the database under an older one. Otherwise a read racing
+// with a change could put the permissions from before the change back.
+type permissionCache struct {
+	ttl         time.Duration
+	mu          sync.Mutex
+	entries     map[int64]permissionCacheEntry
+	generations map[int64]uint64
+	lastSweep   time.Time
+	hits        atomic.Int64
+	misses      atomic.Int64
+}
+
+func newPermissionCache(ttl time.Duration) *permissionCache {
+	return &permissionCache{
+		ttl:         ttl,
+		entries:     make(map[int64]permissionCacheEntry),
+		generations: make(map[int64]uint64),
+		lastSweep:   time.Now(),
+	}
+}
+
+func (c *permissionCache) enabled() bool {
+	return c != nil && c.ttl > 0
+}
+
+// get returns a copy of the cached permissions of userID. On a miss it returns
+// the generation to hand to set along with the permissions read instead.
+func (c *permissionCache) get(userID int64) (Permissions, uint64, bool) {
+	if !c.enabled() {
+		return nil, 0, false
+	}
+
+	c.mu.Lock()
+	entry, found := c.entries[userID]
+	generation := c.generations[userID]
+	c.mu.Unlock()
+
+	if !found || time.Now().After(entry.expiry) {
+		c.misses.Add(1)
+		return nil, generation, false
+	}
+
+	c.hits.Add(1)
+	return append(Permissions(nil), entry.permissions...), generation, true
+}
+
+func (c *permissionCache) set(userID int64, generation uint64, permissions Permissions) {
+	if !c.enabled() {
+		return
+	}
+
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.generations[userID] != generation {
+		return
+	}
+
+	c.entries[userID] = permissionCacheEntry{
+		permissions: append(Permissions(nil), permissions...),
+		expiry:      now.Add(c.ttl),
+	}
+
+	if now.Sub(c.lastSweep) < c.ttl {
+		return
+	}
+
+	for id, entry := range c.entries {
+		if now.After(entry.expiry) {
+			delete(c.entries, id)
+		}
+	}
+	c.lastSweep = now
+}
+
+func (c *permissionCache) invalidate(userID int64) {
+	if !c.enabled() {
+		return
+	}
+
+	c.mu.Lock()
+	delete(c.entries, userID)
+	c.generations[userID]++
+	c.mu.Unlock()
+}
+
+func (c *permissionCache) stats() PermissionCacheStats {
+	if c == nil {
+		return PermissionCacheStats{}
+	}
+
+	c.mu.Lock()
+	entries := len(c.entries)
+	c.mu.Unlock()
+
+	return PermissionCacheStats{
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+		Entries: entries,
+	}
+}
@@ -0,0 +1,61 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type Roles []string
+
+type RoleModel struct {
+	DB *sql.DB
+}
+
+func (m *RoleModel) Exists(code string) (bool, error) {
+	query := `select exists(select 1 from roles where code = $1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var exists bool
+
+	err := m.DB.QueryRowContext(ctx, query, code).Scan(&exists)
+	return exists, err
+}
+
+func (m *RoleModel) GetAllForUser(userID int64) (Roles, error) {
+	query := `select r.code from roles r
+	inner join users_roles ur on r.id = ur.role_id
+	where ur.user_id = $1
+	order by r.code`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	sqlRows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var roles Roles
+
+	defer sqlRows.Close()
+
+	for sqlRows.Next() {
+		var role string
+
+		err = sqlRows.Scan(&role)
+		if err != nil {
+			return nil, err
+		}
+
+		roles = append(roles, role)
+	}
+
+	if err = sqlRows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
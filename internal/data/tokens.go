@@ -4,24 +4,41 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/base32"
 	"time"
 
+	"github.com/lib/pq"
 	"goplex.kibonga/internal/validator"
 )
 
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopePasswordReset  = "password-reset"
+	ScopeEmailChange    = "email-change"
+	ScopeRefresh        = "refresh"
+	ScopeTwoFactor      = "2fa-challenge"
+	ScopeMagicLogin     = "magic-login"
+	ScopeImpersonation  = "impersonation"
 )
 
+// sessionScopes are the scopes of the tokens that keep a user logged in.
+var sessionScopes = []string{ScopeAuthentication, ScopeRefresh}
+
 type Token struct {
-	PlainText string    `json:"token"`
-	Hash      []byte    `json:"-"`
-	UserID    int64     `json:"-"`
-	Expiry    time.Time `json:"expiry"`
-	Scope     string    `json:"-"`
+	Id             int64     `json:"-"`
+	PlainText      string    `json:"token"`
+	Hash           []byte    `json:"-"`
+	UserID         int64     `json:"-"`
+	Expiry         time.Time `json:"expiry"`
+	Scope          string    `json:"-"`
+	CreatedAt      time.Time `json:"-"`
+	LastUsedAt     time.Time `json:"-"`
+	UserAgent      string    `json:"-"`
+	IP             string    `json:"-"`
+	ImpersonatorID int64     `json:"-"`
 }
 
 type TokenModel struct {
@@ -44,12 +61,20 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 
 	token.PlainText = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randBytes)
 
-	hash := sha256.Sum256([]byte(token.PlainText))
-	token.Hash = hash[:]
+	token.Hash = hashToken(token.PlainText)
 
 	return token, nil
 }
 
+func hashToken(plaintext string) []byte {
+	hash := sha256.Sum256([]byte(plaintext))
+	return hash[:]
+}
+
+func (t *Token) MatchesPlaintext(plaintext string) bool {
+	return subtle.ConstantTimeCompare(t.Hash, hashToken(plaintext)) == 1
+}
+
 func ValidateToken(v *validator.Validator, t *Token) {
 	ValidatePlaintextToken(v, t.PlainText)
 }
@@ -59,12 +84,45 @@ func ValidatePlaintextToken(v *validator.Validator, token string) {
 	v.Check(len(token) == 26, "token", "must be 26 bytes long")
 }
 
-func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+// Client identifies who a token was issued to, so that tokens that keep a
+// user logged in can be listed as sessions later on.
+type Client struct {
+	UserAgent string
+	IP        string
+}
+
+// New issues a token for userID. The optional client is recorded along with
+// it.
+func (m TokenModel) New(userID int64, ttl time.Duration, scope string, client ...Client) (*Token, error) {
 	token, err := generateToken(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
 
+	if len(client) > 0 {
+		token.UserAgent = client[0].UserAgent
+		token.IP = client[0].IP
+	}
+
+	err = m.Insert(token)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// NewImpersonation issues a token that lets impersonatorID act as userID.
+func (m TokenModel) NewImpersonation(userID, impersonatorID int64, ttl time.Duration, userAgent, ip string) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeImpersonation)
+	if err != nil {
+		return nil, err
+	}
+
+	token.ImpersonatorID = impersonatorID
+	token.UserAgent = userAgent
+	token.IP = ip
+
 	err = m.Insert(token)
 	if err != nil {
 		return nil, err
@@ -74,16 +132,16 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 }
 
 func (m TokenModel) Insert(t *Token) error {
-	query := `insert into tokens (hash, user_id, expiry, scope)
-	values ($1, $2, $3, $4)`
+	query := `insert into tokens (hash, user_id, expiry, scope, user_agent, ip, impersonator_id)
+	values ($1, $2, $3, $4, $5, $6, nullif($7::bigint, 0))
+	returning id, created_at, last_used_at`
 
-	args := []interface{}{t.Hash, t.UserID, t.Expiry, t.Scope}
+	args := []interface{}{t.Hash, t.UserID, t.Expiry, t.Scope, t.UserAgent, t.IP, t.ImpersonatorID}
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*300)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, args...)
-	return err
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&t.Id, &t.CreatedAt, &t.LastUsedAt)
 }
 
 func (m TokenModel) DeleteTokensForUser(scope string, userID int64) error {
@@ -96,3 +154,123 @@ func (m TokenModel) DeleteTokensForUser(scope string, userID int64) error {
 	_, err := m.DB.ExecContext(ctx, query, userID, scope)
 	return err
 }
+
+func (m TokenModel) Delete(scope, plaintext string) error {
+	query := `delete from tokens
+	where hash = $1 and scope = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	sqlRes, err := m.DB.ExecContext(ctx, query, hashToken(plaintext), scope)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := sqlRes.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (m TokenModel) GetSessionsForUser(userID int64) ([]*Token, error) {
+	query := `select id, hash, user_id, expiry, scope, created_at, last_used_at, user_agent, ip
+	from tokens
+	where user_id = $1 and scope = any($2) and expiry > $3
+	order by last_used_at desc, id desc`
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	sqlRows, err := m.DB.QueryContext(ctx, query, userID, pq.Array(sessionScopes), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer sqlRows.Close()
+
+	tokens := []*Token{}
+
+	for sqlRows.Next() {
+		var t Token
+
+		err = sqlRows.Scan(&t.Id, &t.Hash, &t.UserID, &t.Expiry, &t.Scope, &t.CreatedAt, &t.LastUsedAt, &t.UserAgent, &t.IP)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, &t)
+	}
+
+	if err = sqlRows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+func (m TokenModel) DeleteSessionForUser(id, userID int64) error {
+	query := `delete from tokens
+	where id = $1 and user_id = $2 and scope = any($3)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	sqlRes, err := m.DB.ExecContext(ctx, query, id, userID, pq.Array(sessionScopes))
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := sqlRes.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (m TokenModel) UpdateLastUsed(plaintext string, lastUsedAt time.Time) error {
+	query := `update tokens
+	set last_used_at = $1
+	where hash = $2 and last_used_at < $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, lastUsedAt, hashToken(plaintext))
+	return err
+}
+
+func (m TokenModel) DeleteSessionsForUser(userID int64) error {
+	query := `delete from tokens
+	where user_id = $1 and scope = any($2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(sessionScopes))
+	return err
+}
+
+// DeleteOtherSessionsForUser logs the user out everywhere except for the
+// caller's session. That is the session with id currentID for callers using a
+// signed access token, or the one matching plaintext otherwise.
+func (m TokenModel) DeleteOtherSessionsForUser(userID, currentID int64, plaintext string) error {
+	query := `delete from tokens
+	where user_id = $1 and scope = any($2) and id <> $3 and hash <> $4`
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(sessionScopes), currentID, hashToken(plaintext))
+	return err
+}
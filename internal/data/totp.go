@@ -0,0 +1,206 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+)
+
+const recoveryCodesCount = 10
+
+type TOTP struct {
+	UserID       int64
+	Secret       []byte
+	Enabled      bool
+	LastUsedStep int64
+	CreatedAt    time.Time
+}
+
+type TOTPModel struct {
+	DB *sql.DB
+}
+
+// Enroll stores a new secret for the user, replacing any enrollment that was
+// started but never confirmed. The secret only takes effect once enabled.
+func (m TOTPModel) Enroll(userID int64, secret []byte) error {
+	query := `insert into users_totp (user_id, secret)
+	values ($1, $2)
+	on conflict (user_id) do update
+	set secret = excluded.secret, enabled = false, last_used_step = 0, created_at = now()
+	where users_totp.enabled = false`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, secret)
+	return err
+}
+
+func (m TOTPModel) GetForUser(userID int64) (*TOTP, error) {
+	query := `select user_id, secret, enabled, last_used_step, created_at
+	from users_totp
+	where user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var t TOTP
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&t.UserID, &t.Secret, &t.Enabled, &t.LastUsedStep, &t.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &t, nil
+}
+
+// IsEnabled reports whether the user has to pass a second factor to log in.
+func (m TOTPModel) IsEnabled(userID int64) (bool, error) {
+	query := `select exists(select 1 from users_totp where user_id = $1 and enabled)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var enabled bool
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&enabled)
+	return enabled, err
+}
+
+// Enable turns on two-factor authentication for the user and issues their
+// recovery codes, both or neither. The plaintext codes are only ever returned
+// here, the database keeps their hashes.
+func (m TOTPModel) Enable(userID int64) ([]string, error) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `update users_totp set enabled = true where user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from totp_recovery_codes where user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, code := range codes {
+		_, err = tx.ExecContext(ctx, `insert into totp_recovery_codes (user_id, hash) values ($1, $2)`, userID, hashToken(code))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// UseStep records that the code for step has been used. It returns false when
+// that step, or a later one, was already used, so a code can't be replayed.
+func (m TOTPModel) UseStep(userID, step int64) (bool, error) {
+	query := `update users_totp
+	set last_used_step = $2
+	where user_id = $1 and last_used_step < $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	sqlRes, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := sqlRes.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+func (m TOTPModel) Delete(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `delete from totp_recovery_codes where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from users_totp where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodesCount)
+
+	for i := range codes {
+		randBytes := make([]byte, 10)
+
+		_, err := rand.Read(randBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(randBytes))
+		codes[i] = code[:8] + "-" + code[8:]
+	}
+
+	return codes, nil
+}
+
+// UseRecoveryCode consumes a recovery code, it returns false when the code
+// doesn't belong to the user or was already used.
+func (m TOTPModel) UseRecoveryCode(userID int64, code string) (bool, error) {
+	query := `delete from totp_recovery_codes
+	where user_id = $1 and hash = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	sqlRes, err := m.DB.ExecContext(ctx, query, userID, hashToken(strings.ToLower(strings.TrimSpace(code))))
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := sqlRes.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
@@ -2,13 +2,15 @@ package data
 
 import (
 	"context"
-	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
+	"math"
 	"strings"
 	"time"
+	"unicode"
 
-	"golang.org/x/crypto/bcrypt"
+	"github.com/lib/pq"
 	"goplex.kibonga/internal/validator"
 )
 
@@ -20,50 +22,21 @@ var (
 var AnonymousUser = &User{}
 
 type User struct {
-	Id        int64     `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Password  password  `json:"-"`
-	Activated bool      `json:"activated"`
-	Version   int32     `json:"-"`
+	Id           int64     `json:"id"`
+	CreatedAt    time.Time `json:"created_at"`
+	Name         string    `json:"name"`
+	Email        string    `json:"email"`
+	PendingEmail string    `json:"-"`
+	Password     password  `json:"-"`
+	Activated    bool      `json:"activated"`
+	Suspended    bool      `json:"suspended"`
+	Version      int32     `json:"-"`
 }
 
 type UserModel struct {
 	DB *sql.DB
 }
 
-type password struct {
-	plaintext *string
-	hash      []byte
-}
-
-func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
-	if err != nil {
-		return err
-	}
-
-	p.hash = hash
-	p.plaintext = &plaintextPassword
-
-	return nil
-}
-
-func (p *password) Matches(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, err
-		default:
-			return false, nil
-		}
-	}
-
-	return true, nil
-}
-
 func ValidateUser(v *validator.Validator, u *User) {
 	validateName(v, u.Name)
 	ValidateEmail(v, u.Email)
@@ -83,16 +56,84 @@ func ValidatePassword(v *validator.Validator, p *password) {
 	if p.plaintext != nil {
 		ValidatePasswordPlaintext(v, *p.plaintext)
 	}
-
-	if p.hash == nil {
-		panic("missing password hash for user")
-	}
 }
 
 func ValidatePasswordPlaintext(v *validator.Validator, password string) {
 	v.Check(len(password) > 0, "password", "is required")
 	v.Check(minPasswordLen(password), "password", "must be at least 8 bytes long")
-	v.Check(maxPasswordLen(password), "password", "must not be more than 72 bytes")
+	v.Check(maxPasswordLen(password), "password", "must not be more than 256 bytes")
+}
+
+// ValidatePasswordStrength rejects passwords that are easy to guess for
+// someone who knows the user, or easy to guess at all.
+func ValidatePasswordStrength(v *validator.Validator, password, name, email string) {
+	v.Check(!containsPersonalInfo(password, name, email), "password", "must not contain your name or email address")
+	v.Check(passwordEntropy(password) >= minPasswordEntropy, "password", "is too easy to guess, use a longer mix of different characters")
+}
+
+// minPasswordEntropy is the least estimated entropy, in bits, a password may
+// have. It lets through 8 different lowercase letters and digits.
+const minPasswordEntropy = 36
+
+func containsPersonalInfo(password, name, email string) bool {
+	password = strings.ToLower(password)
+
+	parts := strings.Fields(strings.ToLower(name))
+
+	if local, _, found := strings.Cut(strings.ToLower(email), "@"); found {
+		parts = append(parts, local)
+	}
+
+	for _, part := range parts {
+		if len(part) >= 3 && strings.Contains(password, part) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// passwordEntropy is a rough estimate of the bits of entropy in password. Only
+// distinct characters count, so repeats and patterns like "abababab" score low.
+func passwordEntropy(password string) float64 {
+	var lower, upper, digit, other bool
+
+	distinct := make(map[rune]bool)
+
+	for _, r := range password {
+		distinct[r] = true
+
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+
+	pool := 0
+	if lower {
+		pool += 26
+	}
+	if upper {
+		pool += 26
+	}
+	if digit {
+		pool += 10
+	}
+	if other {
+		pool += 33
+	}
+
+	if pool == 0 {
+		return 0
+	}
+
+	return float64(len(distinct)) * math.Log2(float64(pool))
 }
 
 func minPasswordLen(password string) bool {
@@ -100,7 +141,7 @@ func minPasswordLen(password string) bool {
 }
 
 func maxPasswordLen(password string) bool {
-	return len(password) <= 72
+	return len(password) <= 256
 }
 
 func validateName(v *validator.Validator, name string) {
@@ -122,7 +163,7 @@ func (m UserModel) Insert(u *User) error {
 	values($1, $2, $3, $4)
 	returning id, created_at, version`
 
-	args := []interface{}{u.Name, u.Email, u.Password.hash, u.Activated}
+	args := []interface{}{u.Name, u.Email, u.Password.value(), u.Activated}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -140,8 +181,92 @@ func (m UserModel) Insert(u *User) error {
 	return nil
 }
 
+// Register inserts a new user and grants them role, all in one transaction.
+// With an invitationCode the invitation is consumed as well, and its
+// permissions, when it has any, are granted instead of role. It returns
+// ErrInvalidInvitation when the invitation can't be used.
+func (m UserModel) Register(u *User, role, invitationCode string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var invitation *Invitation
+
+	if invitationCode != "" {
+		invitation, err = consumeInvitation(ctx, tx, invitationCode, u.Email)
+		if err != nil {
+			return err
+		}
+	}
+
+	query := `insert into users (name, email, password_hash, activated)
+	values($1, $2, $3, $4)
+	returning id, created_at, version`
+
+	args := []interface{}{u.Name, u.Email, u.Password.value(), u.Activated}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&u.Id, &u.CreatedAt, &u.Version)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), duplicateEmailConstraint):
+			return ErrDuplicateEmail
+		default:
+			return err
+		}
+	}
+
+	if invitation != nil && len(invitation.Permissions) > 0 {
+		query = `insert into users_permissions(user_id, permission_id)
+		select $1, id from permissions where code = any($2)`
+
+		_, err = tx.ExecContext(ctx, query, u.Id, pq.Array(invitation.Permissions))
+	} else {
+		query = `insert into users_roles(user_id, role_id)
+		select $1, id from roles where code = $2`
+
+		_, err = tx.ExecContext(ctx, query, u.Id, role)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `select id, created_at, name, email, pending_email, password_hash, activated, suspended, version
+	from users
+	where id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var u User
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&u.Id, &u.CreatedAt, &u.Name, &u.Email, &u.PendingEmail, &u.Password.hash, &u.Activated, &u.Suspended, &u.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &u, nil
+}
+
 func (m UserModel) GetByEmail(email string) (*User, error) {
-	query := `select id, created_at, name, password_hash, activated, version
+	query := `select id, created_at, name, pending_email, password_hash, activated, suspended, version
 	from users
 	where email = $1`
 
@@ -150,7 +275,7 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 
 	var u User
 
-	err := m.DB.QueryRowContext(ctx, query, email).Scan(&u.Id, &u.CreatedAt, &u.Name, &u.Password.hash, &u.Activated, &u.Version)
+	err := m.DB.QueryRowContext(ctx, query, email).Scan(&u.Id, &u.CreatedAt, &u.Name, &u.PendingEmail, &u.Password.hash, &u.Activated, &u.Suspended, &u.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -167,11 +292,11 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 
 func (m UserModel) Update(u *User) error {
 	query := `update users
-	set name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-	where id = $5 and version = $6
+	set name = $1, email = $2, pending_email = $3, password_hash = $4, activated = $5, suspended = $6, version = version + 1
+	where id = $7 and version = $8
 	returning version`
 
-	args := []interface{}{u.Name, u.Email, u.Password.hash, u.Activated, u.Id, u.Version}
+	args := []interface{}{u.Name, u.Email, u.PendingEmail, u.Password.value(), u.Activated, u.Suspended, u.Id, u.Version}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -192,16 +317,52 @@ func (m UserModel) Update(u *User) error {
 }
 
 func (m UserModel) GetByToken(tokenScope, token string) (*User, error) {
-	query := `select id, created_at, name, email, password_hash, activated, version from users u
+	query := `select u.id, u.created_at, u.name, u.email, u.pending_email, u.password_hash, u.activated, u.suspended, u.version from users u
 	inner join tokens t on u.id = t.user_id
 	where t.hash = $1 and t.scope = $2 and t.expiry > $3`
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
 	defer cancel()
 
-	token_hash := sha256.Sum256([]byte(token))
+	args := []interface{}{hashToken(token), tokenScope, time.Now()}
 
-	args := []interface{}{token_hash[:], tokenScope, time.Now()}
+	var user User
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.Id,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.PendingEmail,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Suspended,
+		&user.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// GetBySession returns the user a session belongs to, as long as the session,
+// which is a refresh token, hasn't expired or been revoked.
+func (m UserModel) GetBySession(userID, sessionID int64) (*User, error) {
+	query := `select u.id, u.created_at, u.name, u.email, u.pending_email, u.password_hash, u.activated, u.suspended, u.version from users u
+	inner join tokens t on u.id = t.user_id
+	where t.id = $1 and t.user_id = $2 and t.scope = $3 and t.expiry > $4`
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	args := []interface{}{sessionID, userID, ScopeRefresh, time.Now()}
 
 	var user User
 
@@ -210,8 +371,10 @@ func (m UserModel) GetByToken(tokenScope, token string) (*User, error) {
 		&user.CreatedAt,
 		&user.Name,
 		&user.Email,
+		&user.PendingEmail,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Suspended,
 		&user.Version,
 	)
 
@@ -227,6 +390,97 @@ func (m UserModel) GetByToken(tokenScope, token string) (*User, error) {
 	return &user, nil
 }
 
+// GetByAuthenticationToken returns the user an authentication or impersonation
+// token belongs to, along with the id of the admin impersonating them, which is
+// 0 for authentication tokens. Impersonation tokens stop working as soon as
+// their admin is suspended or loses users:admin.
+func (m UserModel) GetByAuthenticationToken(token string) (*User, int64, error) {
+	query := `select u.id, u.created_at, u.name, u.email, u.pending_email, u.password_hash, u.activated, u.suspended, u.version, coalesce(t.impersonator_id, 0) from users u
+	inner join tokens t on u.id = t.user_id
+	left join users i on i.id = t.impersonator_id
+	where t.hash = $1 and t.expiry > $2 and (t.scope = $3 or (t.scope = $4 and not i.suspended and exists(
+		select 1 from users_permissions up
+		inner join permissions p on p.id = up.permission_id
+		where up.user_id = i.id and p.code = 'users:admin'
+		union all
+		select 1 from users_roles ur
+		inner join roles_permissions rp on rp.role_id = ur.role_id
+		inner join permissions p on p.id = rp.permission_id
+		where ur.user_id = i.id and p.code = 'users:admin'
+	)))`
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	args := []interface{}{hashToken(token), time.Now(), ScopeAuthentication, ScopeImpersonation}
+
+	var user User
+	var impersonatorID int64
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.Id,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.PendingEmail,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Suspended,
+		&user.Version,
+		&impersonatorID,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, 0, ErrRecordNotFound
+		default:
+			return nil, 0, err
+		}
+	}
+
+	return &user, impersonatorID, nil
+}
+
+func (m UserModel) GetAll(search string, filters *Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`select count(*) over(), id, created_at, name, email, pending_email, password_hash, activated, suspended, version
+	from users
+	where (name ilike '%%' || $1 || '%%' or email ilike '%%' || $1 || '%%' or $1 = '')
+	order by %s %s, id asc limit $2 offset $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{search, filters.limit(), filters.offset()}
+
+	sqlRows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer sqlRows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for sqlRows.Next() {
+		var u User
+
+		err = sqlRows.Scan(&totalRecords, &u.Id, &u.CreatedAt, &u.Name, &u.Email, &u.PendingEmail, &u.Password.hash, &u.Activated, &u.Suspended, &u.Version)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		users = append(users, &u)
+	}
+
+	if err := sqlRows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return users, metadata, nil
+}
+
 func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }
@@ -0,0 +1,102 @@
+package jwt
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+type testClaims struct {
+	Claims
+	Session int64 `json:"sid"`
+}
+
+func newTestClaims(expiresIn time.Duration) *testClaims {
+	now := time.Now()
+
+	return &testClaims{
+		Claims: Claims{
+			Subject:   "42",
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(expiresIn).Unix(),
+		},
+		Session: 7,
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	want := newTestClaims(time.Minute)
+
+	token, err := Sign(want, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !LooksLikeToken(token) {
+		t.Errorf("LooksLikeToken(%q) = false", token)
+	}
+
+	var got testClaims
+
+	err = Verify(token, testKey, &got)
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+
+	if got != *want {
+		t.Errorf("Verify() claims = %+v, want %+v", got, *want)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	valid, err := Sign(newTestClaims(time.Minute), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(valid, ".")
+
+	tampered, err := Sign(&testClaims{Claims: newTestClaims(time.Minute).Claims, Session: 8}, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A header naming another algorithm, signed with the right key so that
+	// only the algorithm check can reject it
+	noneHeader := encoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	noneUnsigned := noneHeader + "." + parts[1]
+	none := noneUnsigned + "." + encoding.EncodeToString(sign(noneUnsigned, testKey))
+
+	expired, err := Sign(newTestClaims(-time.Minute), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		key   []byte
+		want  error
+	}{
+		{"tampered payload", parts[0] + "." + strings.Split(tampered, ".")[1] + "." + parts[2], testKey, ErrInvalidToken},
+		{"wrong key", valid, []byte("fedcba9876543210fedcba9876543210"), ErrInvalidToken},
+		{"other algorithm", none, testKey, ErrInvalidToken},
+		{"unsigned", parts[0] + "." + parts[1] + ".", testKey, ErrInvalidToken},
+		{"malformed", "not-a-token", testKey, ErrInvalidToken},
+		{"expired", expired, testKey, ErrExpiredToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var claims testClaims
+
+			err := Verify(tt.token, tt.key, &claims)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Verify() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+const movie = `{"title":"Moana","genres":["animation","adventure"],"version":1}`
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		patch   string
+		want    string
+		wantErr error
+	}{
+		{
+			name:  "add to the end of an array",
+			patch: `[{"op":"add","path":"/genres/-","value":"family"}]`,
+			want:  `{"title":"Moana","genres":["animation","adventure","family"],"version":1}`,
+		},
+		{
+			name:  "add at an index",
+			patch: `[{"op":"add","path":"/genres/1","value":"family"}]`,
+			want:  `{"title":"Moana","genres":["animation","family","adventure"],"version":1}`,
+		},
+		{
+			name:  "add a member",
+			patch: `[{"op":"add","path":"/runtime","value":107}]`,
+			want:  `{"title":"Moana","genres":["animation","adventure"],"runtime":107,"version":1}`,
+		},
+		{
+			name:  "remove",
+			patch: `[{"op":"remove","path":"/genres/0"}]`,
+			want:  `{"title":"Moana","genres":["adventure"],"version":1}`,
+		},
+		{
+			name:  "replace",
+			patch: `[{"op":"replace","path":"/title","value":"Vaiana"}]`,
+			want:  `{"title":"Vaiana","genres":["animation","adventure"],"version":1}`,
+		},
+		{
+			name:  "passing test",
+			patch: `[{"op":"test","path":"/version","value":1},{"op":"replace","path":"/title","value":"Vaiana"}]`,
+			want:  `{"title":"Vaiana","genres":["animation","adventure"],"version":1}`,
+		},
+		{
+			name:    "failing test",
+			patch:   `[{"op":"replace","path":"/title","value":"Vaiana"},{"op":"test","path":"/version","value":2}]`,
+			wantErr: ErrTestFailed,
+		},
+		{
+			name:    "missing path",
+			patch:   `[{"op":"replace","path":"/runtime","value":107}]`,
+			wantErr: ErrPathNotFound,
+		},
+		{
+			name:    "index out of range",
+			patch:   `[{"op":"remove","path":"/genres/2"}]`,
+			wantErr: ErrPathNotFound,
+		},
+		{
+			name:    "leading zero index",
+			patch:   `[{"op":"replace","path":"/genres/01","value":"family"}]`,
+			wantErr: ErrPathNotFound,
+		},
+		{
+			name:    "missing value",
+			patch:   `[{"op":"add","path":"/runtime"}]`,
+			wantErr: ErrInvalidPatch,
+		},
+		{
+			name:    "unsupported op",
+			patch:   `[{"op":"move","from":"/title","path":"/name"}]`,
+			wantErr: ErrInvalidPatch,
+		},
+		{
+			name:    "not an array of operations",
+			patch:   `{"op":"remove","path":"/title"}`,
+			wantErr: ErrInvalidPatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Apply([]byte(movie), []byte(tt.patch))
+
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Apply() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Apply() error = %v", err)
+			}
+
+			assertJSONEqual(t, got, tt.want)
+		})
+	}
+}
+
+func TestApplyTestFailedPath(t *testing.T) {
+	_, err := Apply([]byte(movie), []byte(`[{"op":"test","path":"/genres/1","value":"family"}]`))
+
+	var testErr *TestFailedError
+	if !errors.As(err, &testErr) {
+		t.Fatalf("Apply() error = %v, want a *TestFailedError", err)
+	}
+
+	if testErr.Path != "/genres/1" {
+		t.Errorf("TestFailedError.Path = %q, want %q", testErr.Path, "/genres/1")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name  string
+		patch string
+		want  string
+	}{
+		{
+			name:  "replace a member",
+			patch: `{"title":"Vaiana"}`,
+			want:  `{"title":"Vaiana","genres":["animation","adventure"],"version":1}`,
+		},
+		{
+			name:  "null removes a member",
+			patch: `{"genres":null}`,
+			want:  `{"title":"Moana","version":1}`,
+		},
+		{
+			name:  "arrays are replaced whole",
+			patch: `{"genres":["family"]}`,
+			want:  `{"title":"Moana","genres":["family"],"version":1}`,
+		},
+		{
+			name:  "null for a missing member",
+			patch: `{"runtime":null}`,
+			want:  movie,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Merge([]byte(movie), []byte(tt.patch))
+			if err != nil {
+				t.Fatalf("Merge() error = %v", err)
+			}
+
+			assertJSONEqual(t, got, tt.want)
+		})
+	}
+}
+
+func assertJSONEqual(t *testing.T, got []byte, want string) {
+	t.Helper()
+
+	var g, w interface{}
+
+	err := json.Unmarshal(got, &g)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = json.Unmarshal([]byte(want), &w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(g, w) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,5 @@
+alter table tokens drop column if exists ip;
+alter table tokens drop column if exists user_agent;
+alter table tokens drop column if exists last_used_at;
+alter table tokens drop column if exists created_at;
+alter table tokens drop column if exists id;
\ No newline at end of file
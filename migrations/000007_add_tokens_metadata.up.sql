@@ -0,0 +1,5 @@
+alter table tokens add column if not exists id bigserial unique;
+alter table tokens add column if not exists created_at timestamp(0) with time zone not null default now();
+alter table tokens add column if not exists last_used_at timestamp(0) with time zone not null default now();
+alter table tokens add column if not exists user_agent text not null default '';
+alter table tokens add column if not exists ip text not null default '';
\ No newline at end of file
@@ -0,0 +1 @@
+alter table users add column if not exists pending_email citext not null default '';
\ No newline at end of file
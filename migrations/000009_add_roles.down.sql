@@ -0,0 +1,3 @@
+drop table if exists users_roles;
+drop table if exists roles_permissions;
+drop table if exists roles;
\ No newline at end of file
@@ -0,0 +1,28 @@
+create table if not exists roles(
+    id bigserial primary key,
+    code text unique not null
+);
+
+create table if not exists roles_permissions(
+    role_id bigint not null references roles (id) on delete cascade,
+    permission_id bigint not null references permissions (id) on delete cascade,
+    primary key (role_id, permission_id)
+);
+
+create table if not exists users_roles(
+    user_id bigint not null references users (id) on delete cascade,
+    role_id bigint not null references roles (id) on delete cascade,
+    primary key (user_id, role_id)
+);
+
+insert into roles (code)
+values
+    ('viewer'),
+    ('editor'),
+    ('admin');
+
+insert into roles_permissions (role_id, permission_id)
+select r.id, p.id from roles r, permissions p
+where (r.code = 'viewer' and p.code = 'movies:read')
+    or (r.code = 'editor' and p.code in ('movies:read', 'movies:write'))
+    or r.code = 'admin'
\ No newline at end of file
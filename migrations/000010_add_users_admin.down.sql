@@ -0,0 +1,3 @@
+delete from permissions where code = 'users:admin';
+
+alter table users drop column if exists suspended;
\ No newline at end of file
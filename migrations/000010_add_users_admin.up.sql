@@ -0,0 +1,9 @@
+alter table users add column if not exists suspended bool not null default false;
+
+insert into permissions (code)
+values
+    ('users:admin');
+
+insert into roles_permissions (role_id, permission_id)
+select r.id, p.id from roles r, permissions p
+where r.code = 'admin' and p.code = 'users:admin'
\ No newline at end of file
@@ -0,0 +1,11 @@
+create table if not exists api_keys (
+    id bigserial primary key,
+    user_id bigint not null references users on delete cascade,
+    name text not null,
+    hash bytea unique not null,
+    permissions text[] not null,
+    expiry timestamp(0) with time zone,
+    created_at timestamp(0) with time zone not null default now()
+);
+
+create index if not exists api_keys_user_id_idx on api_keys (user_id)
\ No newline at end of file
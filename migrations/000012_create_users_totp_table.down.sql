@@ -0,0 +1,2 @@
+drop table if exists totp_recovery_codes;
+drop table if exists users_totp;
\ No newline at end of file
@@ -0,0 +1,13 @@
+create table if not exists users_totp (
+    user_id bigint primary key references users on delete cascade,
+    secret bytea not null,
+    enabled bool not null default false,
+    last_used_step bigint not null default 0,
+    created_at timestamp(0) with time zone not null default now()
+);
+
+create table if not exists totp_recovery_codes (
+    user_id bigint not null references users on delete cascade,
+    hash bytea not null,
+    primary key (user_id, hash)
+)
\ No newline at end of file
@@ -0,0 +1,6 @@
+create table if not exists login_attempts (
+    email citext primary key,
+    failed_count integer not null default 0,
+    last_failed_at timestamp(0) with time zone not null default now(),
+    locked_until timestamp(0) with time zone
+)
\ No newline at end of file
@@ -0,0 +1,10 @@
+-- Users without a password would be locked out for good, so they have to set
+-- one before this can be rolled back
+do $$
+begin
+    if exists (select 1 from users where password_hash is null) then
+        raise exception 'users without a password exist, they must set one first';
+    end if;
+end $$;
+
+alter table users alter column password_hash set not null;
\ No newline at end of file
@@ -0,0 +1 @@
+alter table users alter column password_hash drop not null;
\ No newline at end of file
@@ -0,0 +1,12 @@
+create table if not exists invitations (
+    id bigserial primary key,
+    hash bytea unique not null,
+    email citext,
+    permissions text[] not null default '{}',
+    max_uses integer not null default 1,
+    uses integer not null default 0,
+    expiry timestamp(0) with time zone not null,
+    created_by bigint references users on delete set null,
+    created_at timestamp(0) with time zone not null default now(),
+    constraint invitations_uses_check check (uses between 0 and max_uses)
+);
\ No newline at end of file
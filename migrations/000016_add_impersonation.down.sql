@@ -0,0 +1,4 @@
+drop table if exists audit_log;
+
+delete from tokens where impersonator_id is not null;
+alter table tokens drop column if exists impersonator_id;
\ No newline at end of file
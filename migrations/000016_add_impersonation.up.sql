@@ -0,0 +1,15 @@
+alter table tokens add column if not exists impersonator_id bigint references users on delete cascade;
+
+create table if not exists audit_log (
+    id bigserial primary key,
+    user_id bigint references users on delete set null,
+    impersonator_id bigint references users on delete set null,
+    method text not null,
+    path text not null,
+    status integer not null,
+    ip text not null default '',
+    created_at timestamp(0) with time zone not null default now()
+);
+
+create index if not exists audit_log_user_id_idx on audit_log (user_id);
+create index if not exists audit_log_impersonator_id_idx on audit_log (impersonator_id);
\ No newline at end of file
@@ -0,0 +1 @@
+alter table movies drop column if exists updated_at;
\ No newline at end of file
@@ -0,0 +1,3 @@
+alter table movies add column if not exists updated_at timestamp(0) with time zone not null default now();
+
+update movies set updated_at = created_at;
\ No newline at end of file
@@ -0,0 +1 @@
+drop table if exists movie_revisions;
\ No newline at end of file
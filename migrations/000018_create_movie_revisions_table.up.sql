@@ -0,0 +1,26 @@
+create table if not exists movie_revisions (
+    id bigserial primary key,
+    movie_id bigint not null,
+    version integer not null,
+    action text not null,
+    user_id bigint references users on delete set null,
+    snapshot jsonb not null,
+    diff jsonb not null default '{}',
+    created_at timestamp(0) with time zone not null default now(),
+    unique (movie_id, version)
+);
+
+-- Movies from before revisions were recorded get one for their current state,
+-- so that every movie has a history
+insert into movie_revisions (movie_id, version, action, snapshot, diff, created_at)
+select id, version, 'insert',
+    jsonb_build_object('title', title, 'year', year, 'runtime', runtime || ' mins', 'genres', to_jsonb(genres)),
+    jsonb_build_object(
+        'title', jsonb_build_object('from', null, 'to', title),
+        'year', jsonb_build_object('from', null, 'to', year),
+        'runtime', jsonb_build_object('from', null, 'to', runtime || ' mins'),
+        'genres', jsonb_build_object('from', null, 'to', to_jsonb(genres))
+    ),
+    created_at
+from movies
+on conflict (movie_id, version) do nothing;
\ No newline at end of file
@@ -0,0 +1,14 @@
+-- Movies in the trash could still be restored, so they have to be restored or
+-- purged before this can be rolled back
+do $$
+begin
+    if exists (select 1 from movies where deleted_at is not null) then
+        raise exception 'movies in the trash exist, they must be restored or purged first';
+    end if;
+end $$;
+
+delete from permissions where code = 'movies:admin';
+
+drop index if exists movies_deleted_at_idx;
+
+alter table movies drop column if exists deleted_at;
\ No newline at end of file
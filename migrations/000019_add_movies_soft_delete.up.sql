@@ -0,0 +1,11 @@
+alter table movies add column if not exists deleted_at timestamp(0) with time zone;
+
+create index if not exists movies_deleted_at_idx on movies (deleted_at) where deleted_at is not null;
+
+insert into permissions (code)
+values
+    ('movies:admin');
+
+insert into roles_permissions (role_id, permission_id)
+select r.id, p.id from roles r, permissions p
+where r.code = 'admin' and p.code = 'movies:admin'
\ No newline at end of file